@@ -0,0 +1,338 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// englishStopWords are the stop words of Elasticsearch's english analyzer
+var englishStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "but": true, "by": true,
+	"for": true, "if": true, "in": true, "into": true, "is": true, "it": true, "no": true, "not": true, "of": true,
+	"on": true, "or": true, "such": true, "that": true, "the": true, "their": true, "then": true, "there": true,
+	"these": true, "they": true, "this": true, "to": true, "was": true, "will": true, "with": true,
+}
+
+// analyzeEnglish approximates Elasticsearch's english analyzer, which the mapping uses for every text field:
+// standard tokenizer, possessive stemmer, lowercase, english stop words and the Porter stemmer.
+func analyzeEnglish(text string) []string {
+	var terms []string
+	for _, token := range tokenize(text) {
+		token = strings.ToLower(token)
+		token = strings.TrimSuffix(strings.TrimSuffix(token, "'s"), "’s")
+		if token == "" || englishStopWords[token] {
+			continue
+		}
+		terms = append(terms, porterStem(token))
+	}
+	return terms
+}
+
+// tokenize approximates the standard tokenizer's Unicode word boundaries: tokens are runs of letters, digits and
+// underscores, which may also contain a '.', ':' or apostrophe between letters (e.g. bob's) or a '.', ',', ';'
+// or apostrophe between digits (e.g. 2.8). Anything else, like the '.' in 123.jpg, breaks the token.
+func tokenize(text string) []string {
+	var (
+		tokens []string
+		rs     = []rune(text)
+		start  = -1
+	)
+	isWordRune := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' }
+	isMid := func(i int) bool {
+		if i == 0 || i+1 >= len(rs) {
+			return false
+		}
+		prev, next := rs[i-1], rs[i+1]
+		switch rs[i] {
+		case '.', '\'', '’':
+			return unicode.IsLetter(prev) && unicode.IsLetter(next) || unicode.IsDigit(prev) && unicode.IsDigit(next)
+		case ':':
+			return unicode.IsLetter(prev) && unicode.IsLetter(next)
+		case ',', ';':
+			return unicode.IsDigit(prev) && unicode.IsDigit(next)
+		}
+		return false
+	}
+	for i, r := range rs {
+		switch {
+		case isWordRune(r):
+			if start < 0 {
+				start = i
+			}
+		case start >= 0 && isMid(i):
+			// mid-word punctuation; keeps the token going
+		case start >= 0:
+			tokens, start = append(tokens, string(rs[start:i])), -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, string(rs[start:]))
+	}
+	return tokens
+}
+
+// porterStem is the original Porter stemming algorithm, as Lucene's PorterStemFilter implements it.
+// Words that aren't plain lowercase ASCII, or that are shorter than 3 letters, are left as is.
+func porterStem(word string) string {
+	if len(word) < 3 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+	s := &stemmer{b: []byte(word), k: len(word) - 1}
+	s.step1ab()
+	s.step1c()
+	s.step2()
+	s.step3()
+	s.step4()
+	s.step5()
+	return string(s.b[:s.k+1])
+}
+
+// stemmer holds the word being stemmed in b[0..k]; j marks the end of the stem while checking a suffix
+type stemmer struct {
+	b    []byte
+	j, k int
+}
+
+// cons is true if b[i] is a consonant; 'y' is a consonant unless it follows one
+func (s *stemmer) cons(i int) bool {
+	switch s.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !s.cons(i-1)
+	}
+	return true
+}
+
+// m counts the consonant-vowel sequences in b[0..j], i.e. <c>(vc)^m<v>
+func (s *stemmer) m() int {
+	var n, i int
+	for ; ; i++ {
+		if i > s.j {
+			return n
+		}
+		if !s.cons(i) {
+			break
+		}
+	}
+	for i++; ; i++ {
+		for ; ; i++ {
+			if i > s.j {
+				return n
+			}
+			if s.cons(i) {
+				break
+			}
+		}
+		n++
+		for i++; ; i++ {
+			if i > s.j {
+				return n
+			}
+			if !s.cons(i) {
+				break
+			}
+		}
+	}
+}
+
+// vowelInStem is true if b[0..j] has a vowel
+func (s *stemmer) vowelInStem() bool {
+	for i := 0; i <= s.j; i++ {
+		if !s.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// doubleC is true if b[i-1..i] is a double consonant
+func (s *stemmer) doubleC(i int) bool {
+	return i >= 1 && s.b[i] == s.b[i-1] && s.cons(i)
+}
+
+// cvc is true if b[i-2..i] is consonant-vowel-consonant and the last consonant isn't w, x or y (e.g. hop, but not snow)
+func (s *stemmer) cvc(i int) bool {
+	if i < 2 || !s.cons(i) || s.cons(i-1) || !s.cons(i-2) {
+		return false
+	}
+	switch s.b[i] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+// ends is true if b[0..k] ends with suffix, in which case j is set to the end of the stem
+func (s *stemmer) ends(suffix string) bool {
+	l := len(suffix)
+	if l > s.k+1 || string(s.b[s.k-l+1:s.k+1]) != suffix {
+		return false
+	}
+	s.j = s.k - l
+	return true
+}
+
+// setTo replaces b[j+1..k] with suffix
+func (s *stemmer) setTo(suffix string) {
+	s.b = append(s.b[:s.j+1], suffix...)
+	s.k = s.j + len(suffix)
+}
+
+// r replaces the suffix if the stem has at least one consonant-vowel sequence
+func (s *stemmer) r(suffix string) {
+	if s.m() > 0 {
+		s.setTo(suffix)
+	}
+}
+
+// step1ab removes plurals, -ed and -ing (e.g. caresses -> caress, ponies -> poni, meetings -> meet)
+func (s *stemmer) step1ab() {
+	if s.b[s.k] == 's' {
+		switch {
+		case s.ends("sses"):
+			s.k -= 2
+		case s.ends("ies"):
+			s.setTo("i")
+		case s.b[s.k-1] != 's':
+			s.k--
+		}
+	}
+	if s.ends("eed") {
+		if s.m() > 0 {
+			s.k--
+		}
+	} else if (s.ends("ed") || s.ends("ing")) && s.vowelInStem() {
+		s.k = s.j
+		switch {
+		case s.ends("at"):
+			s.setTo("ate")
+		case s.ends("bl"):
+			s.setTo("ble")
+		case s.ends("iz"):
+			s.setTo("ize")
+		case s.doubleC(s.k):
+			s.k--
+			switch s.b[s.k] {
+			case 'l', 's', 'z':
+				s.k++
+			}
+		default:
+			s.j = s.k
+			if s.m() == 1 && s.cvc(s.k) {
+				s.setTo("e")
+			}
+		}
+	}
+}
+
+// step1c turns a terminal y into i when there's another vowel in the stem
+func (s *stemmer) step1c() {
+	if s.ends("y") && s.vowelInStem() {
+		s.b[s.k] = 'i'
+	}
+}
+
+// replaceFirst tries each suffix -> replacement pair in order, replacing the first one that matches
+func (s *stemmer) replaceFirst(pairs ...string) {
+	for i := 0; i < len(pairs); i += 2 {
+		if s.ends(pairs[i]) {
+			s.r(pairs[i+1])
+			return
+		}
+	}
+}
+
+// step2 maps double suffixes to single ones (e.g. -ization -> -ize)
+func (s *stemmer) step2() {
+	if s.k == 0 {
+		return
+	}
+	switch s.b[s.k-1] {
+	case 'a':
+		s.replaceFirst("ational", "ate", "tional", "tion")
+	case 'c':
+		s.replaceFirst("enci", "ence", "anci", "ance")
+	case 'e':
+		s.replaceFirst("izer", "ize")
+	case 'l':
+		s.replaceFirst("bli", "ble", "alli", "al", "entli", "ent", "eli", "e", "ousli", "ous")
+	case 'o':
+		s.replaceFirst("ization", "ize", "ation", "ate", "ator", "ate")
+	case 's':
+		s.replaceFirst("alism", "al", "iveness", "ive", "fulness", "ful", "ousness", "ous")
+	case 't':
+		s.replaceFirst("aliti", "al", "iviti", "ive", "biliti", "ble")
+	case 'g':
+		s.replaceFirst("logi", "log")
+	}
+}
+
+// step3 deals with -ic-, -full, -ness etc.
+func (s *stemmer) step3() {
+	switch s.b[s.k] {
+	case 'e':
+		s.replaceFirst("icate", "ic", "ative", "", "alize", "al")
+	case 'i':
+		s.replaceFirst("iciti", "ic")
+	case 'l':
+		s.replaceFirst("ical", "ic", "ful", "")
+	case 's':
+		s.replaceFirst("ness", "")
+	}
+}
+
+// step4 removes -ant, -ence etc. when the stem has more than one consonant-vowel sequence
+func (s *stemmer) step4() {
+	if s.k == 0 {
+		return
+	}
+	var matched bool
+	switch s.b[s.k-1] {
+	case 'a':
+		matched = s.ends("al")
+	case 'c':
+		matched = s.ends("ance") || s.ends("ence")
+	case 'e':
+		matched = s.ends("er")
+	case 'i':
+		matched = s.ends("ic")
+	case 'l':
+		matched = s.ends("able") || s.ends("ible")
+	case 'n':
+		matched = s.ends("ant") || s.ends("ement") || s.ends("ment") || s.ends("ent")
+	case 'o':
+		matched = s.ends("ion") && s.j >= 0 && (s.b[s.j] == 's' || s.b[s.j] == 't') || s.ends("ou")
+	case 's':
+		matched = s.ends("ism")
+	case 't':
+		matched = s.ends("ate") || s.ends("iti")
+	case 'u':
+		matched = s.ends("ous")
+	case 'v':
+		matched = s.ends("ive")
+	case 'z':
+		matched = s.ends("ize")
+	}
+	if matched && s.m() > 1 {
+		s.k = s.j
+	}
+}
+
+// step5 removes a final -e and turns -ll into -l when the stem is long enough
+func (s *stemmer) step5() {
+	s.j = s.k
+	if s.b[s.k] == 'e' {
+		if a := s.m(); a > 1 || a == 1 && !s.cvc(s.k-1) {
+			s.k--
+		}
+	}
+	if s.b[s.k] == 'l' && s.doubleC(s.k) && s.m() > 1 {
+		s.k--
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAnalyzeEnglish(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected []string
+	}{
+		{name: "plurals and case", text: "Cameras LENSES", expected: []string{"camera", "lens"}},
+		{name: "stop words", text: "the camera with a lens", expected: []string{"camera", "len"}},
+		{name: "possessives", text: "John's tripod", expected: []string{"john", "tripod"}},
+		{name: "url slugs", text: "london/hire-canon-7d-camera-11908390", expected: []string{"london", "hire", "canon", "7d", "camera", "11908390"}},
+		{name: "image file names", text: "canon-7d-camera-45742621.jpg", expected: []string{"canon", "7d", "camera", "45742621", "jpg"}},
+		{name: "porter stemming", text: "running generalization hopeful", expected: []string{"run", "gener", "hope"}},
+		{name: "nothing to index", text: " // & ", expected: nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := analyzeEnglish(tc.text); !reflect.DeepEqual(tc.expected, actual) {
+				t.Errorf("expected %q but got %q", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// publicPaths skip authentication and rate limits, since probes and scrapers don't have API keys
+var publicPaths = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// apiKeys are the accepted API keys by their sha256, so that looking one up doesn't leak how much of it matched
+type apiKeys map[[sha256.Size]byte]apiKey
+
+// apiKey is what an API key may do. Its name is what shows up in logs and traces instead of the key.
+// Every key can search; only keys with the write scope can write through /items.
+type apiKey struct {
+	name  string
+	write bool
+}
+
+// loadAPIKeys reads the keys of file (one per line, optionally followed by a name and comma separated scopes, e.g.
+// `key partner-a search,write`; # starts a comment) and inline (comma separated, search only)
+func loadAPIKeys(file, inline string) (apiKeys, error) {
+	keys := make(apiKeys)
+	for i, key := range strings.Split(inline, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys[sha256.Sum256([]byte(key))] = apiKey{name: "inline-" + strconv.Itoa(i+1)}
+		}
+	}
+	if file == "" {
+		return keys, nil
+	}
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("loadAPIKeys: error opening %v: %v", file, err)
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if len(fields) == 0 {
+			continue
+		}
+		key := apiKey{name: file + ":" + strconv.Itoa(line)}
+		if len(fields) > 1 {
+			key.name = fields[1]
+		}
+		if len(fields) > 2 {
+			for _, scope := range strings.Split(fields[2], ",") {
+				switch scope {
+				case "search":
+				case "write":
+					key.write = true
+				default:
+					return nil, fmt.Errorf("loadAPIKeys: %v:%v: unknown scope %q; use search or write", file, line, scope)
+				}
+			}
+		}
+		keys[sha256.Sum256([]byte(fields[0]))] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("loadAPIKeys: error reading %v: %v", file, err)
+	}
+	return keys, nil
+}
+
+// apiKeyOf is the API key of a request: its X-API-Key header, or its apiKey query param
+func apiKeyOf(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("apiKey")
+}
+
+// tokenBucket holds up to burst tokens, and gets rate more every second. A request takes one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a tokenBucket per key (e.g. an API key or a client IP). A rate of 0 doesn't limit.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// rateLimiterSweepInterval is how often, at most, a rateLimiter forgets the buckets that filled back up,
+// so that clients that come and go don't grow it forever
+const rateLimiterSweepInterval = time.Minute
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: math.Max(1, float64(burst)), buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// take takes a token from the bucket of key. When it's empty, it returns false and how long until it isn't.
+func (l *rateLimiter) take(key string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > rateLimiterSweepInterval {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// allowList is the networks of internal callers, which skip authentication and rate limits
+type allowList []*net.IPNet
+
+// parseAllowList parses comma separated IPs and CIDRs, e.g. 10.0.0.0/8,192.168.1.7
+func parseAllowList(s string) (allowList, error) {
+	var list allowList
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("parseAllowList: %q isn't an IP or CIDR", entry)
+		}
+		list = append(list, network)
+	}
+	return list, nil
+}
+
+func (l allowList) contains(ip net.IP) bool {
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address the request came from. X-Forwarded-For isn't trusted, since any client can set it.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// authenticator lets requests through when they come from the allow-list, or have a valid API key (if any keys are
+// configured) and are within the rate limits of their client IP and API key
+type authenticator struct {
+	keys      apiKeys
+	allowList allowList
+	byKey     *rateLimiter
+	byIP      *rateLimiter
+}
+
+func newAuthenticator(cfg config) (*authenticator, error) {
+	keys, err := loadAPIKeys(cfg.APIKeysFile, cfg.APIKeys)
+	if err != nil {
+		return nil, fmt.Errorf("newAuthenticator: %v", err)
+	}
+	allow, err := parseAllowList(cfg.AllowList)
+	if err != nil {
+		return nil, fmt.Errorf("newAuthenticator: %v", err)
+	}
+	return &authenticator{keys: keys, allowList: allow, byKey: newRateLimiter(cfg.RateLimit, cfg.RateLimitBurst),
+		byIP: newRateLimiter(cfg.IPRateLimit, cfg.IPRateLimitBurst)}, nil
+}
+
+// middleware answers 401 to requests without a valid API key (if any keys are configured), and 429 with Retry-After
+// to requests over a rate limit. The client IP is limited first, so that guessing keys is rate limited too.
+// The valid API key of a request, if any, goes on its context for requireWriteScope.
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if a.allowList.contains(ip) {
+			next.ServeHTTP(w, r.WithContext(withAPIKey(r.Context(), allowListKey)))
+			return
+		}
+		if ok, retryAfter := a.byIP.take(ip.String()); !ok {
+			rejectedRequests.inc("ip_rate_limit")
+			tooManyRequests(w, r, retryAfter)
+			return
+		}
+		key := apiKeyOf(r)
+		k, ok := a.keys[sha256.Sum256([]byte(key))]
+		if !ok && len(a.keys) > 0 {
+			unauthorized(w, r, key)
+			return
+		}
+		if ok {
+			if span := spanFrom(r.Context()); span != nil {
+				span.setAttr("api_key", k.name)
+			}
+			r = r.WithContext(withAPIKey(r.Context(), k))
+		}
+		if key != "" {
+			if ok, retryAfter := a.byKey.take(key); !ok {
+				rejectedRequests.inc("key_rate_limit")
+				tooManyRequests(w, r, retryAfter)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowListKey is the API key of allow-listed callers, which may do anything
+var allowListKey = apiKey{name: "allow-list", write: true}
+
+type apiKeyKey struct{}
+
+func withAPIKey(ctx context.Context, k apiKey) context.Context {
+	return context.WithValue(ctx, apiKeyKey{}, k)
+}
+
+// apiKeyFrom is the valid API key of the request of ctx, if it has one (see authenticator.middleware)
+func apiKeyFrom(ctx context.Context) (apiKey, bool) {
+	k, ok := ctx.Value(apiKeyKey{}).(apiKey)
+	return k, ok
+}
+
+// requireWriteScope is the middleware of the routes that write items. They need a key with the write scope even when
+// no keys are configured, so that nobody can write to an open deployment: 401 without a valid key, 403 with a key
+// that can't write. It's per route, so that requests that don't match a write route still get their 404 or 405.
+func requireWriteScope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		k, ok := apiKeyFrom(r.Context())
+		if !ok {
+			unauthorized(w, r, apiKeyOf(r))
+			return
+		}
+		if !k.write {
+			rejectedRequests.inc("forbidden")
+			writeError(w, r, http.StatusForbidden, apiError{Code: "forbidden", Message: "the API key can't write", Field: "apiKey"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unauthorized answers 401 with an ApiKey challenge to a request with an invalid key, or none
+func unauthorized(w http.ResponseWriter, r *http.Request, key string) {
+	rejectedRequests.inc("unauthorized")
+	w.Header().Set("WWW-Authenticate", `ApiKey header="X-API-Key"`)
+	problem := apiError{Code: "unauthorized", Message: "a valid API key is required, in the X-API-Key header or the apiKey param", Field: "apiKey"}
+	if key == "" {
+		problem.Code = "missing_api_key"
+	}
+	writeError(w, r, http.StatusUnauthorized, problem)
+}
+
+// tooManyRequests answers 429, with Retry-After in whole seconds, rounded up
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+	w.Header().Set("Retry-After", seconds)
+	writeError(w, r, http.StatusTooManyRequests, apiError{Code: "rate_limited", Message: "too many requests, retry after " + seconds + "s"})
+}
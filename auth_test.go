@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Authentication test sends requests from various clients, with and without API keys, through the authenticator,
+// and expects only the valid ones within their rate limits to reach the handler.
+func TestAuthenticate(t *testing.T) {
+	var keysFile = filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keysFile, []byte("# partners\nfilekey partner-a\n\notherkey\nwritekey ingest search,write\n"), 0600); err != nil {
+		t.Errorf("couldn't write keys file: %v", err)
+		t.FailNow()
+	}
+	type request struct {
+		method, target, key, remoteAddr string
+	}
+	tests := []struct {
+		name                string
+		cfg                 func(c *config)
+		requests            []request
+		expectedStatusCodes []int
+	}{
+		{
+			name:                "no keys configured lets everyone in",
+			cfg:                 func(c *config) { c.APIKeysFile, c.APIKeys = "", "" },
+			requests:            []request{{target: "/search"}},
+			expectedStatusCodes: []int{http.StatusOK},
+		},
+		{
+			name: "valid keys from the file, env or query param",
+			requests: []request{
+				{target: "/search", key: "filekey"}, {target: "/search", key: "otherkey"}, {target: "/search", key: "inlinekey"},
+				{target: "/search?apiKey=filekey"},
+			},
+			expectedStatusCodes: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+		{
+			name:                "missing or invalid key",
+			requests:            []request{{target: "/search"}, {target: "/search", key: "nope"}, {target: "/search?apiKey=filekey2"}},
+			expectedStatusCodes: []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized},
+		},
+		{
+			name:                "probes and metrics don't need a key",
+			requests:            []request{{target: "/healthz"}, {target: "/readyz"}, {target: "/metrics"}},
+			expectedStatusCodes: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+		{
+			name:                "allow-listed callers don't need a key, and aren't limited",
+			cfg:                 func(c *config) { c.AllowList, c.IPRateLimitBurst = "10.0.0.0/8, ::1", 1 },
+			requests:            []request{{target: "/search", remoteAddr: "10.1.2.3:1234"}, {target: "/search", remoteAddr: "10.1.2.3:1234"}, {target: "/search", remoteAddr: "[::1]:1234"}, {target: "/search", remoteAddr: "11.1.2.3:1234"}},
+			expectedStatusCodes: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusUnauthorized},
+		},
+		{
+			name:                "rate limit per key",
+			cfg:                 func(c *config) { c.RateLimitBurst = 2 },
+			requests:            []request{{target: "/search", key: "filekey", remoteAddr: "1.1.1.1:1"}, {target: "/search", key: "filekey", remoteAddr: "1.1.1.2:1"}, {target: "/search", key: "filekey", remoteAddr: "1.1.1.3:1"}, {target: "/search", key: "otherkey", remoteAddr: "1.1.1.4:1"}},
+			expectedStatusCodes: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusOK},
+		},
+		{
+			name:                "rate limit per IP, even with wrong keys",
+			cfg:                 func(c *config) { c.IPRateLimitBurst = 2 },
+			requests:            []request{{target: "/search", key: "nope"}, {target: "/search", key: "filekey"}, {target: "/search", key: "otherkey"}, {target: "/search", key: "otherkey", remoteAddr: "1.1.1.1:1"}},
+			expectedStatusCodes: []int{http.StatusUnauthorized, http.StatusOK, http.StatusTooManyRequests, http.StatusOK},
+		},
+		{
+			name:                "no rate limits",
+			cfg:                 func(c *config) { c.RateLimit, c.RateLimitBurst, c.IPRateLimit, c.IPRateLimitBurst = 0, 1, 0, 1 },
+			requests:            []request{{target: "/search", key: "filekey"}, {target: "/search", key: "filekey"}, {target: "/search", key: "filekey"}},
+			expectedStatusCodes: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var cfg = defaultConfig
+			cfg.APIKeysFile, cfg.APIKeys = keysFile, "inlinekey, "
+			if tc.cfg != nil {
+				tc.cfg(&cfg)
+			}
+			auth, err := newAuthenticator(cfg)
+			if err != nil {
+				t.Errorf("couldn't create authenticator: %v", err)
+				t.FailNow()
+			}
+			handler := auth.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			for i, req := range tc.requests {
+				method := req.method
+				if method == "" {
+					method = "GET"
+				}
+				r := httptest.NewRequest(method, req.target, nil)
+				if req.key != "" {
+					r.Header.Set("X-API-Key", req.key)
+				}
+				if req.remoteAddr != "" {
+					r.RemoteAddr = req.remoteAddr
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if tc.expectedStatusCodes[i] != w.Code {
+					t.Errorf("expected status code %v for request %v but got %v", tc.expectedStatusCodes[i], i, w.Code)
+				}
+				var body errorBody
+				if w.Code != http.StatusOK && (json.NewDecoder(w.Body).Decode(&body) != nil || body.Code == "") {
+					t.Errorf("expected an error body for request %v", i)
+				}
+				switch w.Code {
+				case http.StatusTooManyRequests:
+					if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retryAfter < 1 {
+						t.Errorf("expected a Retry-After in seconds for request %v but got %q", i, w.Header().Get("Retry-After"))
+					}
+				case http.StatusUnauthorized:
+					if w.Header().Get("WWW-Authenticate") == "" {
+						t.Errorf("expected a WWW-Authenticate challenge for request %v", i)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Write scope test sends requests through the authenticator and the routes of an endpointHandler, on an empty
+// memoryStore, and expects only the /items write routes to need a key with the write scope: a 404 means the write
+// got through to the store, and requests that match no write route keep their 404 or 405, with or without keys.
+func TestWriteScope(t *testing.T) {
+	var keysFile = filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keysFile, []byte("filekey partner-a\nwritekey ingest search,write\n"), 0600); err != nil {
+		t.Errorf("couldn't write keys file: %v", err)
+		t.FailNow()
+	}
+	type request struct {
+		method, target, key, remoteAddr string
+	}
+	tests := []struct {
+		name                string
+		cfg                 func(c *config)
+		requests            []request
+		expectedStatusCodes []int
+	}{
+		{
+			name: "writes need a key with the write scope",
+			requests: []request{
+				{method: "POST", target: "/items"}, {method: "POST", target: "/items", key: "filekey"},
+				{method: "DELETE", target: "/items/1", key: "filekey"}, {method: "DELETE", target: "/items/1", key: "writekey"},
+				{method: "GET", target: "/items/1", key: "filekey"},
+			},
+			expectedStatusCodes: []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusForbidden, http.StatusNotFound, http.StatusNotFound},
+		},
+		{
+			name: "writes need a key even when none are configured",
+			cfg:  func(c *config) { c.APIKeysFile = "" },
+			requests: []request{
+				{method: "PATCH", target: "/items/1"}, {method: "PATCH", target: "/items/1", key: "writekey"},
+				{method: "GET", target: "/items/1"},
+			},
+			expectedStatusCodes: []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusNotFound},
+		},
+		{
+			name: "other methods and paths aren't writes",
+			cfg:  func(c *config) { c.APIKeysFile = "" },
+			requests: []request{
+				{method: "POST", target: "/search"}, {method: "DELETE", target: "/v2/search"}, {method: "POST", target: "/items/1"},
+				{method: "POST", target: "/nope"}, {method: "PUT", target: "/items/1/nope"},
+			},
+			expectedStatusCodes: []int{http.StatusMethodNotAllowed, http.StatusMethodNotAllowed, http.StatusMethodNotAllowed, http.StatusNotFound, http.StatusNotFound},
+		},
+		{
+			name:                "allow-listed callers can write",
+			cfg:                 func(c *config) { c.APIKeysFile, c.AllowList = "", "10.0.0.0/8" },
+			requests:            []request{{method: "DELETE", target: "/items/1", remoteAddr: "10.1.2.3:1234"}},
+			expectedStatusCodes: []int{http.StatusNotFound},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var cfg = defaultConfig
+			cfg.APIKeysFile, cfg.APIKeys = keysFile, ""
+			if tc.cfg != nil {
+				tc.cfg(&cfg)
+			}
+			auth, err := newAuthenticator(cfg)
+			if err != nil {
+				t.Errorf("couldn't create authenticator: %v", err)
+				t.FailNow()
+			}
+			handler := chain(newEndpointHandler(newMemoryStore(nil)), recoverPanics, auth.middleware)
+			for i, req := range tc.requests {
+				r := httptest.NewRequest(req.method, req.target, nil)
+				if req.key != "" {
+					r.Header.Set("X-API-Key", req.key)
+				}
+				if req.remoteAddr != "" {
+					r.RemoteAddr = req.remoteAddr
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if tc.expectedStatusCodes[i] != w.Code {
+					t.Errorf("expected status code %v for %v %v but got %v: %v", tc.expectedStatusCodes[i], req.method, req.target, w.Code, w.Body)
+				}
+			}
+		})
+	}
+}
+
+// Rate limiter test expects a bucket to refill at its rate, up to its burst, and idle buckets to be forgotten.
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(100, 2)
+	for i, expected := range []bool{true, true, false} {
+		if ok, retryAfter := l.take("client"); ok != expected || (!ok && (retryAfter <= 0 || retryAfter > 10*time.Millisecond)) {
+			t.Errorf("expected take %v to be %v but got %v, retry after %v", i, expected, ok, retryAfter)
+		}
+	}
+	time.Sleep(30 * time.Millisecond) // refills 3 tokens, but holds 2 at most
+	for i, expected := range []bool{true, true, false} {
+		if ok, _ := l.take("client"); ok != expected {
+			t.Errorf("expected take %v after refilling to be %v but got %v", i, expected, ok)
+		}
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	l.lastSweep = time.Now().Add(-2 * rateLimiterSweepInterval)
+	l.take("other")
+	if _, ok := l.buckets["client"]; ok || len(l.buckets) != 1 {
+		t.Errorf("expected the full bucket of client to be swept but got %v buckets", len(l.buckets))
+	}
+}
+
+// Allow-list test parses IPs and CIDRs, and rejects anything else.
+func TestParseAllowList(t *testing.T) {
+	list, err := parseAllowList("10.0.0.0/8, 192.168.1.7,,2001:db8::/32, ::1")
+	if err != nil || len(list) != 4 {
+		t.Errorf("expected 4 networks but got %v %v", list, err)
+		t.FailNow()
+	}
+	for ip, expected := range map[string]bool{"10.20.30.40": true, "192.168.1.7": true, "192.168.1.8": false, "2001:db8::1": true, "::1": true, "::2": false} {
+		if actual := list.contains(net.ParseIP(ip)); actual != expected {
+			t.Errorf("expected %v to be allowed %v but got %v", ip, expected, actual)
+		}
+	}
+	if _, err := parseAllowList("10.0.0.0/8,intranet"); err == nil {
+		t.Errorf("expected an error for a hostname")
+	}
+}
+
+// API keys test reads names and scopes from a keys file, and rejects unknown scopes.
+func TestLoadAPIKeys(t *testing.T) {
+	var dir = t.TempDir()
+	keysFile, badFile := filepath.Join(dir, "keys"), filepath.Join(dir, "bad")
+	_ = os.WriteFile(keysFile, []byte("a\nb partner-b\nc ingest search,write # the importer\n"), 0600)
+	_ = os.WriteFile(badFile, []byte("a partner-a admin\n"), 0600)
+	keys, err := loadAPIKeys(keysFile, "d")
+	if err != nil {
+		t.Errorf("couldn't load keys: %v", err)
+		t.FailNow()
+	}
+	for key, expected := range map[string]apiKey{"a": {name: keysFile + ":1"}, "b": {name: "partner-b"}, "c": {name: "ingest", write: true}, "d": {name: "inline-1"}} {
+		if actual := keys[sha256.Sum256([]byte(key))]; actual != expected {
+			t.Errorf("expected key %v to be %+v but got %+v", key, expected, actual)
+		}
+	}
+	if _, err := loadAPIKeys(badFile, ""); err == nil || !strings.Contains(err.Error(), `unknown scope "admin"`) {
+		t.Errorf("expected an unknown scope error but got %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// searchCache is an itemStore that caches the searches of another one, in an LRU of up to size results that
+// expire after ttl. Searches are keyed by their normalized term and the geohash of their location at precision, so
+// that nearby users share results. A miss searches from its own location; a hit is re-ranked by its own location
+// (see rerank), so it only differs from an uncached search in which items made the cut, at the edge of the results.
+// Writes through the searchCache invalidate it, and again once the store has had refreshInterval to make them
+// searchable, so that searches in between don't cache stale results for a whole ttl. So does a reindex that replaces
+// the index, which watchGeneration polls for. Results are shared between callers, which must not modify them.
+type searchCache struct {
+	itemStore
+	size            int
+	ttl             time.Duration
+	precision       int
+	refreshInterval time.Duration
+
+	mu         sync.Mutex
+	entries    map[searchCacheKey]*list.Element
+	lru        *list.List // of *searchCacheEntry, most recently used first
+	epoch      int        // incremented by invalidate, so that searches in flight don't cache stale results
+	generation string
+}
+
+type searchCacheKey struct {
+	term, geohash string
+}
+
+type searchCacheEntry struct {
+	key     searchCacheKey
+	loc     location // of the search that result is from
+	result  searchResult
+	expires time.Time
+}
+
+// cacheGenerationCheckInterval is how often watchGeneration checks for a reindex
+const cacheGenerationCheckInterval = 10 * time.Second
+
+// generationer is implemented by stores whose content can be replaced from outside the process, e.g. by a reindex;
+// generation changes when it is
+type generationer interface {
+	generation(ctx context.Context) (string, error)
+}
+
+func newSearchCache(store itemStore, size int, ttl time.Duration, precision int) *searchCache {
+	return &searchCache{itemStore: store, size: size, ttl: ttl, precision: precision,
+		entries: make(map[searchCacheKey]*list.Element), lru: list.New()}
+}
+
+// normalizeSearchTerm is searchTerm as far as the english analyzer is concerned: case and whitespace don't matter
+func normalizeSearchTerm(searchTerm string) string {
+	return strings.ToLower(strings.Join(strings.Fields(searchTerm), " "))
+}
+
+func (c *searchCache) search(ctx context.Context, searchTerm string, loc location) (searchResult, error) {
+	key := searchCacheKey{normalizeSearchTerm(searchTerm), geohash(loc, c.precision)}
+	entry, epoch := c.lookup(key)
+	if span := spanFrom(ctx); span != nil {
+		span.setAttr("cache_hit", entry != nil)
+	}
+	if entry != nil {
+		searchCacheLookups.inc("hit")
+		return rerank(entry.result, entry.loc, loc), nil
+	}
+	searchCacheLookups.inc("miss")
+	res, err := c.itemStore.search(ctx, key.term, loc)
+	if err == nil && !res.timedOut { // partial results would stick around for the whole ttl
+		c.add(key, loc, res, epoch)
+	}
+	return res, err
+}
+
+// lookup returns the unexpired entry of key, if any, and the epoch the cache is at
+func (c *searchCache) lookup(key searchCacheKey) (*searchCacheEntry, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, c.epoch
+	}
+	entry := e.Value.(*searchCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(e)
+		searchCacheEvictions.inc("expired")
+		return nil, c.epoch
+	}
+	c.lru.MoveToFront(e)
+	return entry, c.epoch
+}
+
+// rerank is res, the result of a search from "from", ranked as if it was searched from loc: each item's score is
+// divided by the distance decay from "from" it was scored with, and multiplied by the one from loc, like db.search
+// and memoryStore.search score them. Items scored 0 (too far from "from" to recover their text score) stay last, in
+// their order. res is shared, so the re-ranked result is a copy; results without scores are returned as they are.
+func rerank(res searchResult, from, loc location) searchResult {
+	if from == loc || len(res.scores) != len(res.items) {
+		return res
+	}
+	order := make([]int, len(res.items))
+	scores := make([]float64, len(res.items))
+	for i, it := range res.items {
+		order[i] = i
+		if decay := gaussDecay(distanceMeters(from, it.Location), memoryDecayOffsetMeters, memoryDecayScaleMeters); decay > 0 {
+			scores[i] = res.scores[i] / decay * gaussDecay(distanceMeters(loc, it.Location), memoryDecayOffsetMeters, memoryDecayScaleMeters)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return scores[order[i]] > scores[order[j]] })
+	reranked := searchResult{items: make([]item, len(order)), scores: make([]float64, len(order))}
+	if len(res.ids) == len(res.items) {
+		reranked.ids = make([]string, len(order))
+	}
+	for i, o := range order {
+		reranked.items[i], reranked.scores[i] = res.items[o], scores[o]
+		if reranked.ids != nil {
+			reranked.ids[i] = res.ids[o]
+		}
+	}
+	return reranked
+}
+
+// add caches res, the result of key searched from loc, unless the cache was invalidated since epoch, evicting the
+// least recently used results beyond size
+func (c *searchCache) add(key searchCacheKey, loc location, res searchResult, epoch int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if epoch != c.epoch {
+		return
+	}
+	if e, ok := c.entries[key]; ok { // cached by a concurrent search in the meantime
+		c.remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&searchCacheEntry{key: key, loc: loc, result: res, expires: time.Now().Add(c.ttl)})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		searchCacheEvictions.inc("size")
+	}
+	searchCacheEntries.set(float64(c.lru.Len()))
+}
+
+func (c *searchCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*searchCacheEntry).key)
+	searchCacheEntries.set(float64(c.lru.Len()))
+}
+
+// invalidate empties the cache
+func (c *searchCache) invalidate(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	searchCacheEvictions.add(float64(c.lru.Len()), "invalidated")
+	slog.Info("searchCache: invalidated", "reason", reason, "entries", c.lru.Len())
+	c.entries, c.epoch = make(map[searchCacheKey]*list.Element), c.epoch+1
+	c.lru.Init()
+	searchCacheEntries.set(0)
+}
+
+func (c *searchCache) create(ctx context.Context, id string, it item) error {
+	defer c.invalidateAfterWrite("create")
+	return c.itemStore.create(ctx, id, it)
+}
+
+func (c *searchCache) put(ctx context.Context, id string, it item) (bool, error) {
+	defer c.invalidateAfterWrite("put")
+	return c.itemStore.put(ctx, id, it)
+}
+
+func (c *searchCache) update(ctx context.Context, id string, it item, version itemVersion) error {
+	defer c.invalidateAfterWrite("update")
+	return c.itemStore.update(ctx, id, it, version)
+}
+
+func (c *searchCache) delete(ctx context.Context, id string) error {
+	defer c.invalidateAfterWrite("delete")
+	return c.itemStore.delete(ctx, id)
+}
+
+// invalidateAfterWrite invalidates the cache now, and once the write is searchable
+func (c *searchCache) invalidateAfterWrite(reason string) {
+	c.invalidate(reason)
+	if c.refreshInterval > 0 {
+		time.AfterFunc(c.refreshInterval, func() { c.invalidate(reason + " refreshed") })
+	}
+}
+
+// readiness is the readiness of the cached store, if it has any
+func (c *searchCache) readiness(ctx context.Context) []readinessCheck {
+	if rc, ok := c.itemStore.(readinessChecker); ok {
+		return rc.readiness(ctx)
+	}
+	return []readinessCheck{}
+}
+
+// checkGeneration invalidates the cache if the generation of the cached store changed since the last check
+func (c *searchCache) checkGeneration(ctx context.Context) {
+	g, ok := c.itemStore.(generationer)
+	if !ok {
+		return
+	}
+	generation, err := g.generation(ctx)
+	if err != nil {
+		slog.Warn("searchCache: couldn't check the index generation", "error", err.Error())
+		return
+	}
+	c.mu.Lock()
+	previous := c.generation
+	c.generation = generation
+	c.mu.Unlock()
+	if previous != "" && previous != generation {
+		c.invalidate("reindex: " + previous + " replaced by " + generation)
+	}
+}
+
+// watchGeneration calls checkGeneration every interval, forever
+func (c *searchCache) watchGeneration(interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		c.checkGeneration(ctx)
+		cancel()
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGeohash(t *testing.T) {
+	tests := []struct {
+		loc       location
+		precision int
+		expected  string
+	}{
+		{loc: location{57.64911, 10.40744}, precision: 11, expected: "u4pruydqqvj"},
+		{loc: location{51.5074, -0.1278}, precision: 6, expected: "gcpvj0"},
+		{loc: location{-33.8688, 151.2093}, precision: 5, expected: "r3gx2"},
+	}
+	for _, tc := range tests {
+		actual := geohash(tc.loc, tc.precision)
+		if actual != tc.expected {
+			t.Errorf("expected geohash %v of %v but got %v", tc.expected, tc.loc, actual)
+		}
+	}
+}
+
+// Cache test searches through a searchCache in front of a fakeStore, and expects searches to only reach the
+// fakeStore when the cache doesn't have an equivalent one: same normalized term, same geohash cell.
+func TestSearchCache(t *testing.T) {
+	var (
+		london = location{51.5074, -0.1278}
+		nearby = location{51.5076, -0.1275} // same 1.2km cell
+		paris  = location{48.8566, 2.3522}
+	)
+	type search struct {
+		term string
+		loc  location
+	}
+	tests := []struct {
+		name             string
+		size             int
+		ttl              time.Duration
+		storeErr         error
+		searches         []search
+		between          func(c *searchCache, store *fakeStore) // after the first search
+		expectedSearches int
+	}{
+		{
+			name:             "same search",
+			searches:         []search{{"camera", london}, {"camera", london}},
+			expectedSearches: 1,
+		},
+		{
+			name:             "normalized term and nearby location",
+			searches:         []search{{"camera", london}, {"  Camera ", nearby}},
+			expectedSearches: 1,
+		},
+		{
+			name:             "other term or cell",
+			searches:         []search{{"camera", london}, {"tripod", london}, {"camera", paris}},
+			expectedSearches: 3,
+		},
+		{
+			name:             "least recently used evicted",
+			size:             2,
+			searches:         []search{{"camera", london}, {"tripod", london}, {"camera", london}, {"lens", london}, {"camera", london}, {"tripod", london}},
+			expectedSearches: 4,
+		},
+		{
+			name:             "expired",
+			ttl:              time.Millisecond,
+			searches:         []search{{"camera", london}, {"camera", london}},
+			between:          func(*searchCache, *fakeStore) { time.Sleep(2 * time.Millisecond) },
+			expectedSearches: 2,
+		},
+		{
+			name:             "invalidated by writes",
+			searches:         []search{{"camera", london}, {"camera", london}},
+			between:          func(c *searchCache, _ *fakeStore) { _, _ = c.put(context.Background(), "1", item{}) },
+			expectedSearches: 2,
+		},
+		{
+			name:     "invalidated again once writes are searchable",
+			searches: []search{{"camera", london}, {"camera", london}},
+			between: func(c *searchCache, _ *fakeStore) {
+				c.refreshInterval = 5 * time.Millisecond
+				_, _ = c.put(context.Background(), "1", item{})
+				_, _ = c.search(context.Background(), "camera", london) // before the write is searchable
+				time.Sleep(20 * time.Millisecond)
+			},
+			expectedSearches: 3,
+		},
+		{
+			name:     "invalidated by a reindex",
+			searches: []search{{"camera", london}, {"camera", london}, {"camera", london}},
+			between: func(c *searchCache, store *fakeStore) {
+				c.checkGeneration(context.Background())
+				store.generationID = "items_v2"
+				c.checkGeneration(context.Background())
+			},
+			expectedSearches: 2,
+		},
+		{
+			name:             "errors not cached",
+			storeErr:         fmt.Errorf("search: %w: boom", errStoreUnavailable),
+			searches:         []search{{"camera", london}, {"camera", london}},
+			between:          func(_ *searchCache, store *fakeStore) { store.err = nil },
+			expectedSearches: 2,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				store = &fakeStore{items: []item{{Name: "camera"}}, err: tc.storeErr, generationID: "items_v1"}
+				size  = 100
+				ttl   = time.Minute
+			)
+			if tc.size > 0 {
+				size = tc.size
+			}
+			if tc.ttl > 0 {
+				ttl = tc.ttl
+			}
+			c := newSearchCache(store, size, ttl, 6)
+			for i, s := range tc.searches {
+				if i == 1 && tc.between != nil {
+					tc.between(c, store)
+				}
+				_, _ = c.search(context.Background(), s.term, s.loc)
+			}
+			if len(store.searches) != tc.expectedSearches {
+				t.Errorf("expected %v searches to reach the store but got %v", tc.expectedSearches, store.searches)
+			}
+		})
+	}
+}
+
+// Cache ranking test searches a memoryStore through a searchCache with cells big enough for distance to matter
+// within them, and expects cached results to be ranked like uncached ones from the searcher's own location.
+func TestSearchCacheRanking(t *testing.T) {
+	var (
+		west  = location{51.5, -1.2}
+		east  = location{51.5, -0.2} // about 70km away, in the same 156km cell
+		store = newMemoryStore([]item{
+			{Name: "camera", URL: "london/west", Location: west},
+			{Name: "camera", URL: "london/east", Location: east},
+		})
+		c    = newSearchCache(store, 100, time.Minute, 3)
+		hits = searchCacheLookups.value("hit")
+	)
+	for _, loc := range []location{west, east, west} {
+		cached, err := c.search(context.Background(), "camera", loc)
+		if err != nil {
+			t.Errorf("expected a cached search but got %v", err)
+			t.FailNow()
+		}
+		uncached, _ := store.search(context.Background(), "camera", loc)
+		if fmt.Sprint(cached.ids) != fmt.Sprint(uncached.ids) || cached.items[0].Location != loc {
+			t.Errorf("expected the items %v, nearest %v first, but got %v", uncached.ids, loc, cached.ids)
+		}
+	}
+	if actual := searchCacheLookups.value("hit") - hits; actual != 2 {
+		t.Errorf("expected 2 cache hits but got %v", actual)
+	}
+}
+
+// Cache generation test expects db's generation to change when the index is replaced, like a reindex does.
+func TestDBGeneration(t *testing.T) {
+	var (
+		es = newFakeES(fakeES6, t)
+		db = es.newDB("items", t)
+	)
+	loadItemsIntoTestIndex(`"camera",51,0,london/camera,[]`, false, db, t)
+	before, err := db.generation(context.Background())
+	if err != nil || before == "" {
+		t.Errorf("expected a generation but got %q, %v", before, err)
+	}
+	loadItemsIntoTestIndex(`"camera",51,0,london/camera,[]`, false, db, t)
+	after, _ := db.generation(context.Background())
+	if after == before {
+		t.Errorf("expected the generation to change when the index is replaced but it's still %q", after)
+	}
+
+	cache := newSearchCache(db, 10, time.Minute, 6)
+	w := httptest.NewRecorder()
+	newEndpointHandler(cache).ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != 200 {
+		t.Errorf("expected the cache to pass db's readiness through but got %v %v", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// coalescingStore is an itemStore whose concurrent identical searches (same normalized term and location) share
+// a single search of the store it wraps, so that a spike of the same query costs one ES search rather than one each.
+type coalescingStore struct {
+	itemStore
+	mu      sync.Mutex
+	flights map[searchFlightKey]*searchFlight
+}
+
+type searchFlightKey struct {
+	term string
+	loc  location
+}
+
+// searchFlight is a search in progress, whose result every caller waiting on done gets
+type searchFlight struct {
+	done chan struct{}
+	res  searchResult
+	err  error
+}
+
+func newCoalescingStore(store itemStore) *coalescingStore {
+	return &coalescingStore{itemStore: store, flights: make(map[searchFlightKey]*searchFlight)}
+}
+
+// search joins the flight of an identical search if there's one, or starts one. Callers stop waiting when their
+// own ctx is done, but the flight goes on for the others, until the deadline of the caller that started it. Callers
+// that joined later and still have time left when that deadline passes search again, rather than time out early.
+func (s *coalescingStore) search(ctx context.Context, searchTerm string, loc location) (searchResult, error) {
+	for {
+		res, err := s.searchOnce(ctx, searchTerm, loc)
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil { // the flight's deadline, not ours
+			continue
+		}
+		return res, err
+	}
+}
+
+// searchOnce joins or starts a flight, and waits for it to land or for ctx to be done
+func (s *coalescingStore) searchOnce(ctx context.Context, searchTerm string, loc location) (searchResult, error) {
+	key := searchFlightKey{normalizeSearchTerm(searchTerm), loc}
+	s.mu.Lock()
+	f, joined := s.flights[key]
+	if !joined {
+		f = &searchFlight{done: make(chan struct{})}
+		s.flights[key] = f
+		go s.fly(ctx, key, f)
+	}
+	s.mu.Unlock()
+	if joined {
+		coalescedSearches.inc()
+	}
+	if span := spanFrom(ctx); span != nil {
+		span.setAttr("coalesced", joined)
+	}
+
+	select {
+	case <-f.done:
+		return f.res, f.err
+	case <-ctx.Done():
+		return searchResult{items: []item{}}, fmt.Errorf("search: %w", ctx.Err())
+	}
+}
+
+// fly runs the search of a flight, which doesn't stop when the caller that started it goes away
+func (s *coalescingStore) fly(ctx context.Context, key searchFlightKey, f *searchFlight) {
+	flightCtx, cancel := context.WithoutCancel(ctx), context.CancelFunc(func() {})
+	if deadline, ok := ctx.Deadline(); ok {
+		flightCtx, cancel = context.WithDeadline(flightCtx, deadline)
+	}
+	defer cancel()
+	f.res, f.err = s.itemStore.search(flightCtx, key.term, key.loc)
+
+	s.mu.Lock()
+	delete(s.flights, key)
+	s.mu.Unlock()
+	close(f.done)
+}
+
+// readiness is the readiness of the wrapped store, if it has any
+func (s *coalescingStore) readiness(ctx context.Context) []readinessCheck {
+	if rc, ok := s.itemStore.(readinessChecker); ok {
+		return rc.readiness(ctx)
+	}
+	return []readinessCheck{}
+}
+
+// generation is the generation of the wrapped store, if it has any; see searchCache
+func (s *coalescingStore) generation(ctx context.Context) (string, error) {
+	if g, ok := s.itemStore.(generationer); ok {
+		return g.generation(ctx)
+	}
+	return "", nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingStore is a fakeStore whose searches block until release is closed, so that tests control which
+// searches are in flight at the same time
+type blockingStore struct {
+	fakeStore
+	release chan struct{}
+	started atomic.Int32
+}
+
+func (s *blockingStore) search(ctx context.Context, searchTerm string, loc location) (searchResult, error) {
+	s.started.Add(1)
+	select {
+	case <-s.release:
+		return searchResult{items: s.items}, nil
+	case <-ctx.Done():
+		return searchResult{items: []item{}}, fmt.Errorf("search: %w", ctx.Err())
+	}
+}
+
+// waitForCoalesced waits until n more searches than before joined a flight
+func waitForCoalesced(before float64, n int, t *testing.T) {
+	for deadline := time.Now().Add(5 * time.Second); coalescedSearches.value()-before < float64(n); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Errorf("expected %v searches to join the flight but got %v", n, coalescedSearches.value()-before)
+			t.FailNow()
+		}
+	}
+}
+
+// Coalescing test fires N identical requests in parallel at a backend that holds them, and expects a single search
+// to reach it, whose result every request gets.
+func TestCoalescing(t *testing.T) {
+	const n = 50
+	var (
+		camera  = item{"camera", location{51, 0}, "london/camera", []string{}}
+		store   = &blockingStore{fakeStore: fakeStore{items: []item{camera}}, release: make(chan struct{})}
+		handler = newEndpointHandler(newCoalescingStore(store))
+		before  = coalescedSearches.value()
+		wg      sync.WaitGroup
+		results = make([]*httptest.ResponseRecorder, n)
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = httptest.NewRecorder()
+			target := "/search?searchTerm=camera&lat=51&lng=0"
+			if i%2 == 1 {
+				target = "/search?searchTerm=+CAMERA+&lat=51&lng=0" // the same once normalized
+			}
+			handler.ServeHTTP(results[i], httptest.NewRequest("GET", target, nil))
+		}(i)
+	}
+	waitForCoalesced(before, n-1, t)
+	close(store.release)
+	wg.Wait()
+
+	if actual := store.started.Load(); actual != 1 {
+		t.Errorf("expected 1 search to reach the backend but got %v", actual)
+	}
+	for _, w := range results {
+		var actual []item
+		if err := json.NewDecoder(w.Body).Decode(&actual); w.Code != http.StatusOK || err != nil || !reflect.DeepEqual([]item{camera}, actual) {
+			t.Errorf("expected every request to get the camera but got %v %v", w.Code, actual)
+		}
+	}
+
+	// Once the flight landed, the next search takes off again
+	store.release = make(chan struct{})
+	close(store.release)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/search?searchTerm=camera&lat=51&lng=0", nil))
+	if actual := store.started.Load(); actual != 2 {
+		t.Errorf("expected a later search to reach the backend but got %v searches", actual)
+	}
+}
+
+// Coalescing timeout test expects a caller that gives up to get a 504, without failing the flight for the others.
+func TestCoalescingTimeout(t *testing.T) {
+	var (
+		store   = &blockingStore{fakeStore: fakeStore{items: []item{}}, release: make(chan struct{})}
+		patient = newEndpointHandler(newCoalescingStore(store))
+		hasty   = patient
+		before  = coalescedSearches.value()
+		w       = httptest.NewRecorder()
+		done    = make(chan int)
+	)
+	hasty.searchTimeout = 10 * time.Millisecond
+	go func() {
+		w := httptest.NewRecorder()
+		patient.ServeHTTP(w, httptest.NewRequest("GET", "/search?searchTerm=camera&lat=51&lng=0", nil))
+		done <- w.Code
+	}()
+	for store.started.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	hasty.ServeHTTP(w, httptest.NewRequest("GET", "/search?searchTerm=camera&lat=51&lng=0", nil))
+	waitForCoalesced(before, 1, t)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected the hasty caller to time out but got %v", w.Code)
+	}
+	close(store.release)
+	if actual := <-done; actual != http.StatusOK {
+		t.Errorf("expected the patient caller to get the results but got %v", actual)
+	}
+}
+
+// Coalescing deadline test has a hasty caller start a flight that a patient one joins, and expects the patient
+// caller to still get the results once the hasty caller's deadline, which the flight has, passed.
+func TestCoalescingLateJoiner(t *testing.T) {
+	var (
+		camera  = item{"camera", location{51, 0}, "london/camera", []string{}}
+		store   = &blockingStore{fakeStore: fakeStore{items: []item{camera}}, release: make(chan struct{})}
+		patient = newEndpointHandler(newCoalescingStore(store))
+		hasty   = patient
+		before  = coalescedSearches.value()
+		w       = httptest.NewRecorder()
+		done    = make(chan int)
+	)
+	hasty.searchTimeout = 20 * time.Millisecond
+	patient.searchTimeout = 5 * time.Second
+	go func() {
+		w := httptest.NewRecorder()
+		hasty.ServeHTTP(w, httptest.NewRequest("GET", "/search?searchTerm=camera&lat=51&lng=0", nil))
+		done <- w.Code
+	}()
+	for store.started.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		patient.ServeHTTP(w, httptest.NewRequest("GET", "/search?searchTerm=camera&lat=51&lng=0", nil))
+		done <- w.Code
+	}()
+	waitForCoalesced(before, 1, t)
+	if actual := <-done; actual != http.StatusGatewayTimeout {
+		t.Errorf("expected the hasty caller to time out but got %v", actual)
+	}
+	for deadline := time.Now().Add(5 * time.Second); store.started.Load() < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Errorf("expected the patient caller to search again once the flight's deadline passed")
+			t.FailNow()
+		}
+	}
+	close(store.release)
+	if actual := <-done; actual != http.StatusOK {
+		t.Errorf("expected the patient caller to get the results after the flight's deadline but got %v: %v", actual, w.Body)
+	}
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is everything that changes between environments. Each option is read, in increasing order of precedence,
+// from defaultConfig, the --config JSON or YAML file (e.g. {"es_url": "http://localhost:9200"} or
+// es_url: http://localhost:9200), FL_ env vars (e.g. FL_ES_URL) and --flags (e.g. --es-url). Options are declared
+// once, in configOptions.
+type config struct {
+	ESURL      string
+	ESUser     string
+	ESPassword string
+	ESIndex    string
+	// ESStartupTimeout is how long newDB waits for the cluster to be up and not red
+	ESStartupTimeout duration
+	Dump             string
+	Addr             string
+	Backend          string
+	NoReplaceIndex   bool
+	ValidationRules  string
+	LogLevel         string
+	// SearchTimeout is the deadline of a search, of which ES gets most as its own timeout; see db.search
+	SearchTimeout duration
+	// ItemTimeout is the deadline of a request to /items, i.e. of its reads and writes of the store
+	ItemTimeout duration
+	// V1Deprecation and V1Sunset are when /v1/search (and /search) was deprecated and goes away, for its
+	// Deprecation and Sunset headers; see endpointHandler.searchV1
+	V1Deprecation date
+	V1Sunset      date
+	// RefreshInterval is how soon writes through /items are searchable; see db.setRefreshInterval and searchCache
+	RefreshInterval duration
+	// Search cache; see searchCache
+	CacheSize             int
+	CacheTTL              duration
+	CacheGeohashPrecision int
+	// API keys and rate limits of /search; see authenticator
+	APIKeysFile      string
+	APIKeys          string
+	AllowList        string
+	RateLimit        float64
+	RateLimitBurst   int
+	IPRateLimit      float64
+	IPRateLimitBurst int
+	// CORS, for browser apps on other origins; see corsPolicy
+	CORSAllowedOrigins string
+	CORSAllowedHeaders string
+	CORSMaxAge         duration
+	// Retries and circuit breaker of ES requests; see esResilience
+	ESRetries          int
+	ESRetryBaseDelay   duration
+	ESRetryMaxDelay    duration
+	ESBreakerThreshold int
+	ESBreakerCooldown  duration
+
+	// TLS of the connection to ES; see newESTLSConfig
+	ESCAFile             string
+	ESCertFile           string
+	ESKeyFile            string
+	ESInsecureSkipVerify bool
+	// TLS of the HTTP server; see newServerTLSConfig
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	// Export of tracing spans; see newSpanExporter
+	TraceExporter     string
+	TraceFile         string
+	TraceOTLPEndpoint string
+}
+
+var defaultConfig = config{
+	ESURL:            "http://elasticsearch:9200",
+	ESUser:           "elastic",
+	ESPassword:       "changeme",
+	ESIndex:          "item",
+	ESStartupTimeout: duration{30 * time.Second},
+	Dump:             "dump.csv",
+	Addr:             ":8080",
+	Backend:          "elasticsearch",
+	LogLevel:         "info",
+
+	SearchTimeout: duration{2 * time.Second},
+	ItemTimeout:   duration{5 * time.Second},
+
+	RefreshInterval: duration{time.Second}, // ES's default
+
+	CacheSize:             10000,
+	CacheTTL:              duration{time.Minute},
+	CacheGeohashPrecision: 6,
+
+	RateLimit:        10,
+	RateLimitBurst:   20,
+	IPRateLimit:      20,
+	IPRateLimitBurst: 40,
+
+	CORSAllowedHeaders: "X-API-Key, X-Request-ID, traceparent, tracestate",
+	CORSMaxAge:         duration{10 * time.Minute},
+
+	ESRetries:          3,
+	ESRetryBaseDelay:   duration{50 * time.Millisecond},
+	ESRetryMaxDelay:    duration{time.Second},
+	ESBreakerThreshold: 5,
+	ESBreakerCooldown:  duration{10 * time.Second},
+
+	TraceExporter:     "none",
+	TraceFile:         "traces.jsonl",
+	TraceOTLPEndpoint: "http://localhost:4318/v1/traces",
+}
+
+// configOption is an option of config: the name of its flag, the field it sets, and its usage. Its env var is FL_
+// followed by the name in upper snake case, and its config file key is the name in snake case.
+type configOption struct {
+	name string
+	// field is the field of c the option sets, which is parsed according to its type: a *string, *bool, *int,
+	// *float64, or a type with UnmarshalText and String (e.g. *duration or *date)
+	field  func(c *config) interface{}
+	usage  string
+	secret bool
+}
+
+var configOptions = []configOption{
+	{name: "es-url", field: func(c *config) interface{} { return &c.ESURL }, usage: "Elasticsearch (or OpenSearch) cluster url"},
+	{name: "es-user", field: func(c *config) interface{} { return &c.ESUser }, usage: "Elasticsearch basic auth user"},
+	{name: "es-password", field: func(c *config) interface{} { return &c.ESPassword }, usage: "Elasticsearch basic auth password", secret: true},
+	{name: "es-index", field: func(c *config) interface{} { return &c.ESIndex }, usage: "Elasticsearch index of the items"},
+	{name: "es-startup-timeout", field: func(c *config) interface{} { return &c.ESStartupTimeout }, usage: "how long to wait on startup for Elasticsearch to be up and not red, e.g. 30s"},
+	{name: "es-retries", field: func(c *config) interface{} { return &c.ESRetries }, usage: "how many times Elasticsearch reads are retried on transient failures; 0 disables retries"},
+	{name: "es-retry-base-delay", field: func(c *config) interface{} { return &c.ESRetryBaseDelay }, usage: "delay before the first retry of an Elasticsearch read, doubled on every retry, e.g. 50ms"},
+	{name: "es-retry-max-delay", field: func(c *config) interface{} { return &c.ESRetryMaxDelay }, usage: "longest delay between retries of an Elasticsearch read, e.g. 1s"},
+	{name: "es-breaker-threshold", field: func(c *config) interface{} { return &c.ESBreakerThreshold }, usage: "consecutive failed Elasticsearch requests that open the circuit breaker"},
+	{name: "es-breaker-cooldown", field: func(c *config) interface{} { return &c.ESBreakerCooldown }, usage: "how long the open circuit breaker fails Elasticsearch requests fast before probing, e.g. 10s"},
+	{name: "dump", field: func(c *config) interface{} { return &c.Dump }, usage: "CSV dump loaded on startup, and synced or reported on by default"},
+	{name: "addr", field: func(c *config) interface{} { return &c.Addr }, usage: "address the HTTP server listens on"},
+	// The memory backend doesn't need ES at all: it always loads the dump on startup, and doesn't support sync.
+	{name: "backend", field: func(c *config) interface{} { return &c.Backend }, usage: "search backend: elasticsearch or memory"},
+	// For reviewing convenience, by default, this µs will load the sqlite csv dump onto a fresh `item` index.
+	// This is not at all the responsibility of this µs.
+	// A load balanced setup of replicas of this µs must always set the --no-replace-index flag.
+	// In normal operation, one would expect a different process constantly populating the ES `item` index.
+	{name: "no-replace-index", field: func(c *config) interface{} { return &c.NoReplaceIndex }, usage: "whether to refresh the index on startup"},
+	{name: "validation-rules", field: func(c *config) interface{} { return &c.ValidationRules }, usage: "JSON file overriding the default validation rules run on items before indexing"},
+	{name: "log-level", field: func(c *config) interface{} { return &c.LogLevel }, usage: "lowest level logged: debug, info, warn or error"},
+	{name: "search-timeout", field: func(c *config) interface{} { return &c.SearchTimeout }, usage: "how long a search can take before failing with 504, e.g. 2s"},
+	{name: "item-timeout", field: func(c *config) interface{} { return &c.ItemTimeout }, usage: "how long a read or write of /items can take before failing with 504, e.g. 5s"},
+	{name: "v1-deprecation", field: func(c *config) interface{} { return &c.V1Deprecation }, usage: "when v1 of the API was deprecated, e.g. 2026-10-18, for its Deprecation header; empty for none"},
+	{name: "v1-sunset", field: func(c *config) interface{} { return &c.V1Sunset }, usage: "when v1 of the API goes away, e.g. 2027-06-30, for its Sunset header; empty for none"},
+	{name: "refresh-interval", field: func(c *config) interface{} { return &c.RefreshInterval }, usage: "how soon writes through /items show up in searches, e.g. 1s; the index's refresh interval"},
+	{name: "cache-size", field: func(c *config) interface{} { return &c.CacheSize }, usage: "how many search results the search cache keeps; 0 disables it"},
+	{name: "cache-ttl", field: func(c *config) interface{} { return &c.CacheTTL }, usage: "how long the search cache keeps a result, e.g. 1m"},
+	{name: "cache-geohash-precision", field: func(c *config) interface{} { return &c.CacheGeohashPrecision }, usage: "geohash length (1 to 12) of the locations searches are cached by; 6 is about 1.2km by 0.6km"},
+	{name: "api-keys-file", field: func(c *config) interface{} { return &c.APIKeysFile }, usage: "file of the API keys, one per line, optionally followed by a name and scopes (search, or search,write for /items writes); no keys disables authentication of searches"},
+	{name: "api-keys", field: func(c *config) interface{} { return &c.APIKeys }, usage: "comma separated API keys accepted by /search, on top of api-keys-file; they can't write", secret: true},
+	{name: "allow-list", field: func(c *config) interface{} { return &c.AllowList }, usage: "comma separated IPs and CIDRs of internal callers, which skip API keys and rate limits"},
+	{name: "rate-limit", field: func(c *config) interface{} { return &c.RateLimit }, usage: "requests per second allowed per API key; 0 disables the limit"},
+	{name: "rate-limit-burst", field: func(c *config) interface{} { return &c.RateLimitBurst }, usage: "requests an API key can make at once, above rate-limit"},
+	{name: "ip-rate-limit", field: func(c *config) interface{} { return &c.IPRateLimit }, usage: "requests per second allowed per client IP; 0 disables the limit"},
+	{name: "ip-rate-limit-burst", field: func(c *config) interface{} { return &c.IPRateLimitBurst }, usage: "requests a client IP can make at once, above ip-rate-limit"},
+	{name: "cors-allowed-origins", field: func(c *config) interface{} { return &c.CORSAllowedOrigins }, usage: "comma separated origins (e.g. https://app.example.com) browsers may call the API from, or * for any; none disables CORS"},
+	{name: "cors-allowed-headers", field: func(c *config) interface{} { return &c.CORSAllowedHeaders }, usage: "comma separated request headers browsers may send from cors-allowed-origins"},
+	{name: "cors-max-age", field: func(c *config) interface{} { return &c.CORSMaxAge }, usage: "how long browsers may cache the answer to a preflight request, e.g. 10m"},
+	{name: "es-ca-file", field: func(c *config) interface{} { return &c.ESCAFile }, usage: "PEM bundle of the CAs that sign the ES certificate, instead of the system's"},
+	{name: "es-cert-file", field: func(c *config) interface{} { return &c.ESCertFile }, usage: "PEM client certificate for ES"},
+	{name: "es-key-file", field: func(c *config) interface{} { return &c.ESKeyFile }, usage: "PEM key of es-cert-file"},
+	{name: "es-insecure-skip-verify", field: func(c *config) interface{} { return &c.ESInsecureSkipVerify }, usage: "whether to skip verifying the ES certificate; for development only"},
+	{name: "tls-cert-file", field: func(c *config) interface{} { return &c.TLSCertFile }, usage: "PEM certificate to serve HTTPS with, instead of HTTP"},
+	{name: "tls-key-file", field: func(c *config) interface{} { return &c.TLSKeyFile }, usage: "PEM key of tls-cert-file"},
+	{name: "tls-client-ca-file", field: func(c *config) interface{} { return &c.TLSClientCAFile }, usage: "PEM bundle of the CAs that sign client certificates; requires one from every client (mTLS)"},
+	{name: "trace-exporter", field: func(c *config) interface{} { return &c.TraceExporter }, usage: "where tracing spans go: none, stdout, file (trace-file) or otlp (trace-otlp-endpoint)"},
+	{name: "trace-file", field: func(c *config) interface{} { return &c.TraceFile }, usage: "file the file trace exporter appends spans to, as JSON lines"},
+	{name: "trace-otlp-endpoint", field: func(c *config) interface{} { return &c.TraceOTLPEndpoint }, usage: "OTLP/HTTP traces url of an OpenTelemetry collector, for the otlp trace exporter"},
+}
+
+func setInt(i *int, value string) error {
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("expected an integer but got %q", value)
+	}
+	*i = v
+	return nil
+}
+
+func setFloat(f *float64, value string) error {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("expected a number but got %q", value)
+	}
+	*f = v
+	return nil
+}
+
+// date is a time.Time written like 2026-10-18 (midnight UTC) or 2026-10-18T12:00:00Z, or empty for none
+type date struct {
+	time.Time
+}
+
+func (d *date) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		d.Time = time.Time{}
+		return nil
+	}
+	for _, layout := range []string{time.DateOnly, time.RFC3339} {
+		if v, err := time.Parse(layout, string(text)); err == nil {
+			d.Time = v.UTC()
+			return nil
+		}
+	}
+	return fmt.Errorf("expected a date like 2026-10-18 or 2026-10-18T12:00:00Z but got %q", text)
+}
+
+func (d date) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d date) String() string {
+	switch {
+	case d.IsZero():
+		return ""
+	case d.Equal(d.Truncate(24 * time.Hour)):
+		return d.Format(time.DateOnly)
+	}
+	return d.Format(time.RFC3339)
+}
+
+// duration is a time.Duration written like 2s or 500ms, in flags, env vars and the config file alike
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("expected a duration like 2s or 500ms but got %q", text)
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// indexNameRegexp is what ES accepts as an index name, give or take its length
+var indexNameRegexp = regexp.MustCompile(`^[a-z0-9][^A-Z\\/*?"<>| ,#:]*$`)
+
+func configEnvVar(name string) string {
+	return "FL_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// configFlag is a --flag of a config option. It keeps the raw value so that only flags that
+// were set override the file and env vars.
+type configFlag struct {
+	value   string
+	boolean bool
+}
+
+func (f *configFlag) String() string     { return f.value }
+func (f *configFlag) Set(v string) error { f.value = v; return nil }
+func (f *configFlag) IsBoolFlag() bool   { return f.boolean }
+
+func mustLoadConfig(args []string) (config, []string) {
+	cfg, rest, err := loadConfig(args, os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fatal(err.Error())
+	}
+	return cfg, rest
+}
+
+// loadConfig reads the config from defaultConfig, the config file, env vars (through getenv) and args, and validates it.
+// It also returns the args left after the flags, i.e. the subcommand and its args.
+func loadConfig(args []string, getenv func(string) string) (config, []string, error) {
+	var (
+		cfg        = defaultConfig
+		fs         = flag.NewFlagSet("fl", flag.ContinueOnError)
+		configPath = fs.String("config", getenv("FL_CONFIG"), "JSON config file, e.g. {\"es_url\": \"http://localhost:9200\"}, or YAML if named *.yaml or *.yml (env FL_CONFIG)")
+		flags      = make(map[string]*configFlag)
+	)
+	for _, o := range configOptions {
+		flags[o.name] = &configFlag{boolean: o.boolean()}
+		fs.Var(flags[o.name], o.name, fmt.Sprintf("%v (env %v, default %q)", o.usage, configEnvVar(o.name), defaultConfig.get(o.name)))
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if *configPath != "" {
+		if err := cfg.readFile(*configPath); err != nil {
+			return cfg, nil, err
+		}
+	}
+	for _, o := range configOptions {
+		if v := getenv(configEnvVar(o.name)); v != "" {
+			if err := cfg.set(o.name, v); err != nil {
+				return cfg, nil, fmt.Errorf("loadConfig: %v: %v", configEnvVar(o.name), err)
+			}
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if _, ok := flags[f.Name]; ok && err == nil {
+			if err = cfg.set(f.Name, f.Value.String()); err != nil {
+				err = fmt.Errorf("loadConfig: --%v: %v", f.Name, err)
+			}
+		}
+	})
+	if err != nil {
+		return cfg, nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return cfg, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// readFile sets the options of a JSON config file, or a YAML one if it's named *.yaml or *.yml
+func (c *config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("readFile: error opening config file: %v", err)
+	}
+	var values map[string]string
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		values, err = parseYAMLConfig(data)
+	} else {
+		values, err = parseJSONConfig(data)
+	}
+	if err != nil {
+		return fmt.Errorf("readFile: error parsing %v: %v", path, err)
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // so that the same bad file always gets the same error
+	for _, key := range keys {
+		name := strings.Replace(key, "_", "-", -1)
+		if _, ok := configOptionNamed(name); !ok || strings.Contains(key, "-") {
+			return fmt.Errorf("readFile: error parsing %v: unknown field %q", path, key)
+		}
+		if err := c.set(name, values[key]); err != nil {
+			return fmt.Errorf("readFile: %v: %v: %v", path, key, err)
+		}
+	}
+	return nil
+}
+
+// parseJSONConfig parses a JSON object of options, whose values are strings, numbers or booleans, into their text
+func parseJSONConfig(data []byte) (map[string]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(raw))
+	for key, v := range raw {
+		switch v = bytes.TrimSpace(v); {
+		case len(v) > 0 && v[0] == '"':
+			var s string
+			if err := json.Unmarshal(v, &s); err != nil {
+				return nil, fmt.Errorf("%v: %v", key, err)
+			}
+			values[key] = s
+		case len(v) > 0 && (v[0] == '{' || v[0] == '[') || string(v) == "null":
+			return nil, fmt.Errorf("%v: expected a string, number or boolean but got %s", key, v)
+		default:
+			values[key] = string(v)
+		}
+	}
+	return values, nil
+}
+
+// parseYAMLConfig parses the flat `key: value` lines of a YAML config file, which is all config needs: comments,
+// blank lines, a leading --- and quoted values are fine, but nesting, lists and multi-line values aren't supported
+func parseYAMLConfig(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || (i == 0 && trimmed == "---") {
+			continue
+		}
+		if trimmed != line || strings.HasPrefix(line, "- ") {
+			return nil, fmt.Errorf("line %v: only flat `key: value` lines are supported, not nesting or lists", i+1)
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.ContainsAny(key, " \t\"'") {
+			return nil, fmt.Errorf("line %v: expected `key: value` but got %q", i+1, line)
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("line %v: %v is set twice", i+1, key)
+		}
+		v, err := parseYAMLScalar(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v: %v", i+1, key, err)
+		}
+		values[key] = v
+	}
+	return values, nil
+}
+
+// parseYAMLScalar parses a plain, 'single quoted' or "double quoted" YAML value, without its trailing comment
+func parseYAMLScalar(v string) (string, error) {
+	var (
+		value string
+		rest  string
+	)
+	switch {
+	case strings.HasPrefix(v, `"`):
+		end := 1
+		for ; end < len(v) && v[end] != '"'; end++ {
+			if v[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(v) {
+			return "", fmt.Errorf("unterminated quoted value %v", v)
+		}
+		s, err := strconv.Unquote(v[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted value %v", v[:end+1])
+		}
+		value, rest = s, v[end+1:]
+	case strings.HasPrefix(v, "'"):
+		end := 1
+		for ; end < len(v); end++ {
+			if v[end] == '\'' {
+				if end+1 < len(v) && v[end+1] == '\'' { // '' is an escaped '
+					end++
+					continue
+				}
+				break
+			}
+		}
+		if end >= len(v) {
+			return "", fmt.Errorf("unterminated quoted value %v", v)
+		}
+		value, rest = strings.Replace(v[1:end], "''", "'", -1), v[end+1:]
+	default:
+		if i := strings.Index(v, " #"); i >= 0 {
+			v = strings.TrimSpace(v[:i])
+		}
+		if v != "" && strings.ContainsRune("[{|>&*!", rune(v[0])) {
+			return "", fmt.Errorf("only strings, numbers and booleans are supported, not %v", v)
+		}
+		if v == "~" || v == "null" {
+			return "", fmt.Errorf("expected a value but got %v", v)
+		}
+		return v, nil
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %v after quoted value", rest)
+	}
+	return value, nil
+}
+
+// configOptionNamed is the option of name, if there's one
+func configOptionNamed(name string) (configOption, bool) {
+	for _, o := range configOptions {
+		if o.name == name {
+			return o, true
+		}
+	}
+	return configOption{}, false
+}
+
+// boolean is whether the option is a flag without a value, e.g. --no-replace-index
+func (o configOption) boolean() bool {
+	_, ok := o.field(&config{}).(*bool)
+	return ok
+}
+
+func (c *config) set(name, value string) error {
+	o, ok := configOptionNamed(name)
+	if !ok {
+		return fmt.Errorf("unknown option %q", name)
+	}
+	switch f := o.field(c).(type) {
+	case *string:
+		*f = value
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false but got %q", value)
+		}
+		*f = b
+	case *int:
+		return setInt(f, value)
+	case *float64:
+		return setFloat(f, value)
+	case encoding.TextUnmarshaler:
+		return f.UnmarshalText([]byte(value))
+	default:
+		panic(fmt.Sprintf("set: option %q has a field of unsupported type %T", name, f))
+	}
+	return nil
+}
+
+func (c config) get(name string) string {
+	o, ok := configOptionNamed(name)
+	if !ok {
+		return ""
+	}
+	switch f := o.field(&c).(type) {
+	case *string:
+		return *f
+	case *bool:
+		return strconv.FormatBool(*f)
+	case *int:
+		return strconv.Itoa(*f)
+	case *float64:
+		return strconv.FormatFloat(*f, 'g', -1, 64)
+	case fmt.Stringer:
+		return f.String()
+	default:
+		panic(fmt.Sprintf("get: option %q has a field of unsupported type %T", name, f))
+	}
+}
+
+// validate reports every invalid option at once, so that a bad deploy only needs one fix
+func (c config) validate() error {
+	var problems []string
+	if u, err := url.Parse(c.ESURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("es-url %q isn't an http(s) url", c.ESURL))
+	}
+	if !indexNameRegexp.MatchString(c.ESIndex) || len(c.ESIndex) > 255 {
+		problems = append(problems, fmt.Sprintf("es-index %q isn't a valid index name", c.ESIndex))
+	}
+	if _, port, err := net.SplitHostPort(c.Addr); err != nil || port == "" {
+		problems = append(problems, fmt.Sprintf("addr %q isn't a host:port", c.Addr))
+	}
+	if c.Backend != "elasticsearch" && c.Backend != "memory" {
+		problems = append(problems, fmt.Sprintf("backend %q must be elasticsearch or memory", c.Backend))
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("log-level %q must be debug, info, warn or error", c.LogLevel))
+	}
+	for _, d := range []struct {
+		name  string
+		value duration
+	}{{"es-startup-timeout", c.ESStartupTimeout}, {"es-retry-base-delay", c.ESRetryBaseDelay}, {"es-retry-max-delay", c.ESRetryMaxDelay}, {"es-breaker-cooldown", c.ESBreakerCooldown}, {"search-timeout", c.SearchTimeout}, {"item-timeout", c.ItemTimeout}, {"refresh-interval", c.RefreshInterval}, {"cache-ttl", c.CacheTTL}} {
+		if d.value.Duration <= 0 {
+			problems = append(problems, fmt.Sprintf("%v %v must be positive", d.name, d.value))
+		}
+	}
+	if !c.V1Sunset.IsZero() && c.V1Sunset.Before(c.V1Deprecation.Time) {
+		problems = append(problems, fmt.Sprintf("v1-sunset %v can't be before v1-deprecation %v", c.V1Sunset, c.V1Deprecation))
+	}
+	if c.ESRetries < 0 {
+		problems = append(problems, fmt.Sprintf("es-retries %v can't be negative", c.ESRetries))
+	}
+	if c.ESRetryMaxDelay.Duration < c.ESRetryBaseDelay.Duration {
+		problems = append(problems, fmt.Sprintf("es-retry-max-delay %v can't be shorter than es-retry-base-delay %v", c.ESRetryMaxDelay, c.ESRetryBaseDelay))
+	}
+	if c.ESBreakerThreshold < 1 {
+		problems = append(problems, fmt.Sprintf("es-breaker-threshold %v must be at least 1", c.ESBreakerThreshold))
+	}
+	if c.CacheSize < 0 {
+		problems = append(problems, fmt.Sprintf("cache-size %v can't be negative", c.CacheSize))
+	}
+	if c.CacheGeohashPrecision < 1 || c.CacheGeohashPrecision > 12 {
+		problems = append(problems, fmt.Sprintf("cache-geohash-precision %v must be between 1 and 12", c.CacheGeohashPrecision))
+	}
+	for _, r := range []struct {
+		name  string
+		rate  float64
+		burst int
+	}{{"rate-limit", c.RateLimit, c.RateLimitBurst}, {"ip-rate-limit", c.IPRateLimit, c.IPRateLimitBurst}} {
+		if r.rate < 0 || math.IsNaN(r.rate) || math.IsInf(r.rate, 0) {
+			problems = append(problems, fmt.Sprintf("%v %v must be a positive number, or 0", r.name, r.rate))
+		}
+		if r.burst < 1 {
+			problems = append(problems, fmt.Sprintf("%v-burst %v must be at least 1", r.name, r.burst))
+		}
+	}
+	for _, o := range strings.Split(c.CORSAllowedOrigins, ",") {
+		if o = strings.TrimSpace(o); o == "" || o == "*" {
+			continue
+		}
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			problems = append(problems, fmt.Sprintf("cors-allowed-origins %q isn't a scheme://host[:port] origin", o))
+		}
+	}
+	if c.CORSMaxAge.Duration < 0 {
+		problems = append(problems, fmt.Sprintf("cors-max-age %v can't be negative", c.CORSMaxAge))
+	}
+	if _, err := parseAllowList(c.AllowList); err != nil {
+		problems = append(problems, fmt.Sprintf("allow-list %q has an entry that isn't an IP or CIDR", c.AllowList))
+	}
+	if c.Dump == "" {
+		problems = append(problems, "dump can't be empty")
+	}
+	for _, o := range []string{"validation-rules", "api-keys-file", "es-ca-file", "es-cert-file", "es-key-file", "tls-cert-file", "tls-key-file", "tls-client-ca-file"} {
+		if f := c.get(o); f != "" {
+			if _, err := os.Stat(f); err != nil {
+				problems = append(problems, fmt.Sprintf("%v %q: %v", o, f, err))
+			}
+		}
+	}
+	if (c.ESCertFile == "") != (c.ESKeyFile == "") {
+		problems = append(problems, "es-cert-file and es-key-file go together")
+	}
+	if c.ESCAFile != "" && c.ESInsecureSkipVerify {
+		problems = append(problems, "es-ca-file is pointless with es-insecure-skip-verify")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problems = append(problems, "tls-cert-file and tls-key-file go together")
+	}
+	if c.TLSClientCAFile != "" && c.TLSCertFile == "" {
+		problems = append(problems, "tls-client-ca-file needs tls-cert-file, since mTLS needs TLS")
+	}
+	switch c.TraceExporter {
+	case "none", "stdout":
+	case "file":
+		if c.TraceFile == "" {
+			problems = append(problems, "trace-file can't be empty with the file trace exporter")
+		}
+	case "otlp":
+		if u, err := url.Parse(c.TraceOTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("trace-otlp-endpoint %q isn't an http(s) url", c.TraceOTLPEndpoint))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("trace-exporter %q must be none, stdout, file or otlp", c.TraceExporter))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("validate: invalid config: %v", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// esResilience is the retries and circuit breaker of ES requests
+func (c config) esResilience() esResilience {
+	return esResilience{retries: c.ESRetries, retryBaseDelay: c.ESRetryBaseDelay.Duration, retryMaxDelay: c.ESRetryMaxDelay.Duration,
+		breakerThreshold: c.ESBreakerThreshold, breakerCooldown: c.ESBreakerCooldown.Duration}
+}
+
+// String prints every option with secrets redacted, including passwords in es-url
+func (c config) String() string {
+	var options []string
+	for _, o := range configOptions {
+		v := c.get(o.name)
+		switch {
+		case o.secret && v != "":
+			v = "REDACTED"
+		case o.name == "es-url":
+			if u, err := url.Parse(v); err == nil {
+				v = u.Redacted()
+			}
+		}
+		options = append(options, fmt.Sprintf("%v=%v", o.name, v))
+	}
+	return strings.Join(options, " ")
+}
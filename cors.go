@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsExposedHeaders are the response headers browsers let frontends read, on top of the CORS-safelisted ones;
+// Deprecation, Sunset and Link are how /v1/search tells apps to move to /v2/search
+var corsExposedHeaders = "X-Request-ID, X-Timed-Out, Retry-After, Deprecation, Sunset, Link"
+
+// corsPolicy lets browser apps on other origins call the API: it answers the preflight requests of allowedOrigins
+// (or any origin, with *), and tells browsers they may read the responses. It doesn't allow credentials (cookies),
+// since the API authenticates with API keys.
+type corsPolicy struct {
+	allowedOrigins map[string]bool
+	anyOrigin      bool
+	allowedHeaders string
+	maxAge         time.Duration
+}
+
+// newCORSPolicy parses comma separated origins (e.g. https://app.example.com) and request headers.
+// No origins disables CORS altogether.
+func newCORSPolicy(origins, headers string, maxAge time.Duration) corsPolicy {
+	p := corsPolicy{allowedOrigins: make(map[string]bool), maxAge: maxAge}
+	for _, o := range strings.Split(origins, ",") {
+		switch o = strings.TrimSpace(o); o {
+		case "":
+		case "*":
+			p.anyOrigin = true
+		default:
+			p.allowedOrigins[strings.ToLower(strings.TrimSuffix(o, "/"))] = true
+		}
+	}
+	var allowed []string
+	for _, h := range strings.Split(headers, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			allowed = append(allowed, h)
+		}
+	}
+	p.allowedHeaders = strings.Join(allowed, ", ")
+	return p
+}
+
+func (p corsPolicy) allows(origin string) bool {
+	return origin != "" && (p.anyOrigin || p.allowedOrigins[strings.ToLower(origin)])
+}
+
+// middleware answers preflight requests (OPTIONS with Access-Control-Request-Method) itself: 204 with what's allowed
+// for allowed origins and GET, and 403 otherwise. Any other OPTIONS request goes on to next, like any other method.
+// It goes before authentication, since browsers don't send API keys in preflights. Without any allowed origins,
+// it's next as is.
+func (p corsPolicy) middleware(next http.Handler) http.Handler {
+	if !p.anyOrigin && len(p.allowedOrigins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin") // caches mustn't serve the response of one origin to another
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !p.allows(origin) {
+			if preflight {
+				writeError(w, r, http.StatusForbidden, apiError{Code: "cors_origin_not_allowed", Message: "origin " + origin + " isn't allowed", Field: "Origin"})
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if p.anyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if m := r.Header.Get("Access-Control-Request-Method"); m != http.MethodGet && m != http.MethodHead {
+			writeError(w, r, http.StatusForbidden, apiError{Code: "cors_method_not_allowed", Message: m + " isn't allowed, only GET", Field: "Access-Control-Request-Method"})
+			return
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		if p.allowedHeaders != "" {
+			w.Header().Set("Access-Control-Allow-Headers", p.allowedHeaders)
+		}
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
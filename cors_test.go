@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// CORS test sends simple and preflight requests from allowed and other origins through the CORS policy in front of
+// the handler, and expects preflights to be answered and other methods to still get 405.
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name                string
+		origins             string
+		method              string
+		headers             map[string]string
+		expectedStatusCode  int
+		expectedAllowOrigin string
+		expectedMaxAge      string
+		expectedExposed     string
+	}{
+		{name: "preflight from an allowed origin", origins: "https://app.example.com, https://admin.example.com/", method: "OPTIONS", headers: map[string]string{"Origin": "https://admin.example.com", "Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "x-api-key"}, expectedStatusCode: http.StatusNoContent, expectedAllowOrigin: "https://admin.example.com", expectedMaxAge: "600"},
+		{name: "preflight from any origin", origins: "*", method: "OPTIONS", headers: map[string]string{"Origin": "https://elsewhere.com", "Access-Control-Request-Method": "GET"}, expectedStatusCode: http.StatusNoContent, expectedAllowOrigin: "*", expectedMaxAge: "600"},
+		{name: "preflight from another origin", origins: "https://app.example.com", method: "OPTIONS", headers: map[string]string{"Origin": "https://evil.com", "Access-Control-Request-Method": "GET"}, expectedStatusCode: http.StatusForbidden},
+		{name: "preflight for another method", origins: "https://app.example.com", method: "OPTIONS", headers: map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "DELETE"}, expectedStatusCode: http.StatusForbidden, expectedAllowOrigin: "https://app.example.com"},
+		{name: "preflight without CORS", method: "OPTIONS", headers: map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "GET"}, expectedStatusCode: http.StatusMethodNotAllowed},
+		{name: "GET from an allowed origin", origins: "https://app.example.com", method: "GET", headers: map[string]string{"Origin": "https://app.example.com"}, expectedStatusCode: http.StatusOK, expectedAllowOrigin: "https://app.example.com", expectedExposed: "X-Request-ID, X-Timed-Out, Retry-After, Deprecation, Sunset, Link"},
+		{name: "GET from another origin", origins: "https://app.example.com", method: "GET", headers: map[string]string{"Origin": "https://evil.com"}, expectedStatusCode: http.StatusOK},
+		{name: "GET without an origin", origins: "https://app.example.com", method: "GET", expectedStatusCode: http.StatusOK},
+		{name: "OPTIONS that isn't a preflight", origins: "https://app.example.com", method: "OPTIONS", headers: map[string]string{"Origin": "https://app.example.com"}, expectedStatusCode: http.StatusMethodNotAllowed, expectedAllowOrigin: "https://app.example.com", expectedExposed: corsExposedHeaders},
+		{name: "POST from an allowed origin", origins: "https://app.example.com", method: "POST", headers: map[string]string{"Origin": "https://app.example.com"}, expectedStatusCode: http.StatusMethodNotAllowed, expectedAllowOrigin: "https://app.example.com", expectedExposed: corsExposedHeaders},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				cors    = newCORSPolicy(tc.origins, defaultConfig.CORSAllowedHeaders, 10*time.Minute)
+				handler = cors.middleware(newEndpointHandler(&fakeStore{items: []item{}}))
+				r       = httptest.NewRequest(tc.method, "/healthz", nil)
+				w       = httptest.NewRecorder()
+			)
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			handler.ServeHTTP(w, r)
+			if tc.expectedStatusCode != w.Code {
+				t.Errorf("expected status code %v but got %v", tc.expectedStatusCode, w.Code)
+			}
+			if actual := w.Header().Get("Access-Control-Allow-Origin"); tc.expectedAllowOrigin != actual {
+				t.Errorf("expected Access-Control-Allow-Origin %q but got %q", tc.expectedAllowOrigin, actual)
+			}
+			if actual := w.Header().Get("Access-Control-Max-Age"); tc.expectedMaxAge != actual {
+				t.Errorf("expected Access-Control-Max-Age %q but got %q", tc.expectedMaxAge, actual)
+			}
+			if actual := w.Header().Get("Access-Control-Expose-Headers"); tc.expectedExposed != actual {
+				t.Errorf("expected Access-Control-Expose-Headers %q but got %q", tc.expectedExposed, actual)
+			}
+			if w.Code == http.StatusNoContent {
+				if actual := w.Header().Get("Access-Control-Allow-Headers"); actual != "X-API-Key, X-Request-ID, traceparent, tracestate" {
+					t.Errorf("expected the configured headers to be allowed but got %q", actual)
+				}
+				if actual := w.Header().Get("Access-Control-Allow-Methods"); actual != "GET" {
+					t.Errorf("expected only GET to be allowed but got %q", actual)
+				}
+			}
+		})
+	}
+}
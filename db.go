@@ -2,20 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/olivere/elastic"
 )
 
 type db struct {
-	client *elastic.Client
-	index  string
+	client  *elastic.Client
+	index   string
+	version clusterVersion
+	breaker *circuitBreaker
 }
 
+var _ itemStore = db{}
+
 type location struct {
 	Lat float64 `json:"lat"`
 	Lon float64 `json:"lon"`
@@ -28,73 +38,208 @@ type item struct {
 	ImgURLs  []string `json:"img_urls"`
 }
 
-const mapping = `
-{
-	"mappings":{
-		"item":{
-			"properties":{
-				"name":{
-					"type":"text",
-					"analyzer": "english"
-				},
-				"location":{
-					"type":"geo_point"
-				},
-				"url":{
-					"type":"text",
-					"analyzer": "english"
-				},
-				"img_urls":{
-					"type":"text",
-					"analyzer": "english"
-				}
-			}
-		}
+// properties is the item mapping. Types are gone from ES 7 onwards (and OpenSearch), so mapping nests it
+// under the `item` type only for ES 6.
+const properties = `{
+	"name":{
+		"type":"text",
+		"analyzer": "english"
+	},
+	"location":{
+		"type":"geo_point"
+	},
+	"url":{
+		"type":"text",
+		"analyzer": "english"
+	},
+	"img_urls":{
+		"type":"text",
+		"analyzer": "english"
 	}
 }`
 
-func mustNewDB(url, user, pass, index string) db {
-	db, err := newDB(url, user, pass, index)
+// indexSettings pins the shard layout to ES 6's defaults on every version. Term statistics are per shard, so
+// ES 7's default of 1 shard (and its routing over more routing shards) would otherwise change search rankings.
+const indexSettings = `{
+	"number_of_shards":5,
+	"number_of_routing_shards":5
+}`
+
+// mapping is the body that creates the item index on a cluster of version v
+func mapping(v clusterVersion) string {
+	if v.typeless() {
+		return `{"settings":` + indexSettings + `,"mappings":{"properties":` + properties + `}}`
+	}
+	return `{"settings":` + indexSettings + `,"mappings":{"item":{"properties":` + properties + `}}}`
+}
+
+// clusterVersion is what newDB finds on GET / of the cluster
+type clusterVersion struct {
+	distribution string // elasticsearch or opensearch
+	major        int
+	number       string
+}
+
+func (v clusterVersion) String() string {
+	return v.distribution + " " + v.number
+}
+
+// typeless is true from ES 7 onwards, and for every OpenSearch version (forked off ES 7.10)
+func (v clusterVersion) typeless() bool {
+	return v.distribution == "opensearch" || v.major >= 7
+}
+
+// docType is the type in single document request paths (e.g. /item/_doc/1), which is `_doc` on typeless clusters
+func (v clusterVersion) docType() string {
+	if v.typeless() {
+		return "_doc"
+	}
+	return "item"
+}
+
+// bulkType is the _type of bulk actions, which typeless clusters reject (ES 8) or deprecate (ES 7)
+func (v clusterVersion) bulkType() string {
+	if v.typeless() {
+		return ""
+	}
+	return "item"
+}
+
+// parseClusterVersion reads the version out of the body of GET / on the cluster
+func parseClusterVersion(body []byte) (clusterVersion, error) {
+	var (
+		v   clusterVersion
+		res struct {
+			Version struct {
+				Number       string `json:"number"`
+				Distribution string `json:"distribution"`
+			} `json:"version"`
+		}
+	)
+	if err := json.Unmarshal(body, &res); err != nil {
+		return v, fmt.Errorf("parseClusterVersion: error unmarshalling response: %v", err)
+	}
+	v.number, v.distribution = res.Version.Number, res.Version.Distribution
+	if v.distribution == "" {
+		v.distribution = "elasticsearch"
+	}
+	major, err := strconv.Atoi(strings.SplitN(v.number, ".", 2)[0])
+	if err != nil {
+		return v, fmt.Errorf("parseClusterVersion: unexpected version number %q", v.number)
+	}
+	v.major = major
+	if v.distribution == "elasticsearch" && v.major < 6 || v.distribution != "elasticsearch" && v.distribution != "opensearch" {
+		return v, fmt.Errorf("parseClusterVersion: unsupported cluster %v; supported are elasticsearch 6 to 8 and opensearch", v)
+	}
+	return v, nil
+}
+
+// compatTransport asks typeless clusters for hits.total as a number, which is the only shape the client understands,
+// on searches and scrolls (but not when clearing them). ES 6 rejects the parameter, so it's only added once newDB has found out the version of the cluster.
+type compatTransport struct {
+	next     http.RoundTripper
+	typeless bool
+}
+
+func (t *compatTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.typeless && req.Method != http.MethodDelete && (strings.HasSuffix(req.URL.Path, "/_search") || strings.HasSuffix(req.URL.Path, "/_search/scroll")) {
+		req = req.Clone(req.Context())
+		q := req.URL.Query()
+		q.Set("rest_total_hits_as_int", "true")
+		req.URL.RawQuery = q.Encode()
+	}
+	return t.next.RoundTrip(req)
+}
+
+func mustNewDB(url, user, pass, index string, tlsConfig *tls.Config, startupTimeout time.Duration, resilience esResilience) db {
+	db, err := newDB(url, user, pass, index, tlsConfig, startupTimeout, resilience)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err.Error())
 	}
 	return db
 }
 
-func newDB(url, user, pass, index string) (db, error) {
+// newDB connects to the cluster at url, and finds out its version so that requests have the right shape for it.
+// tlsConfig is optional; see newESTLSConfig.
+// Elasticsearch takes a while to become online, so newDB polls it with backoff, for up to startupTimeout, until
+// it answers and its health isn't red. Every attempt is bounded by the time left, so that a node that accepts
+// connections but doesn't answer can't hold up startup past startupTimeout.
+func newDB(url, user, pass, index string, tlsConfig *tls.Config, startupTimeout time.Duration, resilience esResilience) (db, error) {
 	var (
-		client *elastic.Client
-		err    error
+		client   *elastic.Client
+		next     = http.DefaultTransport.(*http.Transport).Clone()
+		breaker  = &breakerTransport{next: retryTransport{next: next, resilience: resilience}}
+		compat   = &compatTransport{next: tracingTransport{opaqueIDTransport{breaker}}}
+		version  clusterVersion
+		err      error
+		deadline = time.Now().Add(startupTimeout)
 	)
-	for i := 1; i <= 10; i++ { // Try up to 10 times, because Elasticsearch takes a while to become online
-		client, err = elastic.NewClient(elastic.SetSniff(false), elastic.SetURL(url), elastic.SetBasicAuth(user, pass))
+	next.TLSClientConfig = tlsConfig
+	for attempt := 1; ; attempt++ {
+		client, err = elastic.NewClient(elastic.SetSniff(false), elastic.SetURL(url), elastic.SetBasicAuth(user, pass),
+			elastic.SetHttpClient(&http.Client{Transport: compat}))
+		if err == nil {
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			version, err = detectClusterVersion(ctx, client)
+			if err == nil {
+				err = checkClusterHealth(ctx, client)
+			}
+			cancel()
+		}
 		if err == nil {
 			break
 		}
-		log.Printf("newDB: retrying (%v/10) in 1 sec because: %v\n", i, err)
-		time.Sleep(1 * time.Second)
+		wait := backoff(attempt, 500*time.Millisecond, 5*time.Second)
+		if time.Now().Add(wait).After(deadline) {
+			return db{}, fmt.Errorf("newDB: ES cluster wasn't ready within %v: %v", startupTimeout, err)
+		}
+		slog.Warn("newDB: waiting for ES", "attempt", attempt, "wait_ms", wait.Milliseconds(), "error", err.Error())
+		time.Sleep(wait)
+	}
+	compat.typeless = version.typeless()
+	breaker.breaker = newCircuitBreaker(resilience.breakerThreshold, resilience.breakerCooldown)
+	slog.Info("newDB: connected", "cluster", version.String())
+	return db{client: client, index: index, version: version, breaker: breaker.breaker}, nil
+}
+
+func detectClusterVersion(ctx context.Context, client *elastic.Client) (clusterVersion, error) {
+	res, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{Method: "GET", Path: "/"})
+	if err != nil {
+		return clusterVersion{}, fmt.Errorf("detectClusterVersion: GET / failed: %v", err)
+	}
+	return parseClusterVersion(res.Body)
+}
+
+// checkClusterHealth fails while the cluster is red, e.g. still recovering its shards after a restart
+func checkClusterHealth(ctx context.Context, client *elastic.Client) error {
+	res, err := client.ClusterHealth().Do(ctx)
+	if err != nil {
+		return fmt.Errorf("checkClusterHealth: %v", err)
 	}
-	for err != nil {
-		return db{}, fmt.Errorf("newDB: could not connect to ES cluster after 10 retries because: %v", err)
+	if res.Status == "red" {
+		return fmt.Errorf("checkClusterHealth: cluster %v is red", res.ClusterName)
 	}
-	return db{client, index}, nil
+	return nil
 }
 
 // mustReplaceIndex deletes db.index if exists, recreates the index and bulk inserts all items
 func (db db) mustReplaceIndex(items []item) {
-	if err := db.replaceIndex(items); err != nil {
-		log.Fatal(err)
+	if err := db.replaceIndex(context.Background(), items); err != nil {
+		fatal(err.Error())
 	}
 }
 
 // replaceIndex deletes db.index if exists, recreates the index and bulk inserts all items
-func (db db) replaceIndex(items []item) error {
-	exists, err := db.client.IndexExists(db.index).Do(context.Background())
+func (db db) replaceIndex(ctx context.Context, items []item) (err error) {
+	ctx, span := startSpan(ctx, "db.replaceIndex", spanKindInternal)
+	defer func() { span.end(err) }()
+	span.setAttr("items", len(items))
+	exists, err := db.client.IndexExists(db.index).Do(ctx)
 	if err != nil {
 		return fmt.Errorf("replaceIndex: couldn't check if index exists: %v", err)
 	}
 	if exists {
-		res, err := db.client.DeleteIndex(db.index).Do(context.Background())
+		res, err := db.client.DeleteIndex(db.index).Do(ctx)
 		if res == nil || !res.Acknowledged {
 			err = fmt.Errorf("DeleteIndex(%v) wasn't acknowledged by ES", db.index)
 		}
@@ -102,41 +247,125 @@ func (db db) replaceIndex(items []item) error {
 			return fmt.Errorf("replaceIndex: couldn't delete index: %v", err)
 		}
 	}
-	res, err := db.client.CreateIndex(db.index).BodyString(mapping).Do(context.Background())
+	if err := db.createIndex(ctx); err != nil {
+		return fmt.Errorf("replaceIndex: %v", err)
+	}
+	if err := db.bulkInsertItems(ctx, items); err != nil {
+		return err
+	}
+	return nil
+}
+
+// createIndex creates db.index with the item mapping
+func (db db) createIndex(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "db.createIndex", spanKindInternal)
+	defer func() { span.end(err) }()
+	res, err := db.client.CreateIndex(db.index).BodyString(mapping(db.version)).Do(ctx)
 	if res == nil || !res.Acknowledged {
 		err = fmt.Errorf("CreateIndex(%v) wasn't acknowledged by ES", db.index)
 	}
 	if err != nil {
-		return fmt.Errorf("replaceIndex: couldn't create index: %v", err)
+		return fmt.Errorf("couldn't create index: %v", err)
 	}
-	if err := db.bulkInsertItems(items); err != nil {
-		return err
+	return nil
+}
+
+// mustSetRefreshInterval sets how often ES refreshes db.index; see setRefreshInterval
+func (db db) mustSetRefreshInterval(interval time.Duration) {
+	if err := db.setRefreshInterval(context.Background(), interval); err != nil {
+		fatal(err.Error())
+	}
+}
+
+// setRefreshInterval sets how often ES refreshes db.index, i.e. how soon writes to it are searchable.
+// It's a dynamic setting, so it applies to an index that's already there, e.g. with --no-replace-index.
+func (db db) setRefreshInterval(ctx context.Context, interval time.Duration) (err error) {
+	ctx, span := startSpan(ctx, "db.setRefreshInterval", spanKindInternal)
+	defer func() { span.end(err) }()
+	body := fmt.Sprintf(`{"index":{"refresh_interval":"%vms"}}`, interval.Milliseconds())
+	res, err := db.client.IndexPutSettings(db.index).BodyString(body).Do(ctx)
+	if res == nil || !res.Acknowledged {
+		err = fmt.Errorf("IndexPutSettings(%v) wasn't acknowledged by ES", db.index)
+	}
+	if err != nil {
+		return fmt.Errorf("setRefreshInterval: couldn't set the refresh interval: %v", err)
 	}
 	return nil
 }
 
-// Note that bulkInsertItems is only meant to be called once. Otherwise, doc ids will collide.
-// This can be mitigated with a different id strategy, but this method is just a convenience feature for reviewing.
-func (db db) bulkInsertItems(items []item) error {
-	bulkRequest := db.client.Bulk()
+// bulkInsertItems indexes items under their stable ids (see itemIDs), so that a later sync can diff against them.
+// Note that items already on the index under the same ids are overwritten; use sync to also remove stale items.
+func (db db) bulkInsertItems(ctx context.Context, items []item) (err error) {
+	ctx, span := startSpan(ctx, "db.bulkInsertItems", spanKindInternal)
+	defer func() { span.end(err) }()
+	var (
+		bulkRequest = db.client.Bulk()
+		ids         = itemIDs(items)
+	)
 	for i, item := range items {
-		req := elastic.NewBulkIndexRequest().Index(db.index).Type("item").Id(strconv.Itoa(i)).Doc(item)
+		req := elastic.NewBulkIndexRequest().Index(db.index).Type(db.version.bulkType()).Id(ids[i]).Doc(item)
 		bulkRequest = bulkRequest.Add(req)
 	}
-	bulkResponse, err := bulkRequest.Do(context.Background())
+	var start, actions = time.Now(), bulkRequest.NumberOfActions()
+	span.setAttr("actions", actions)
+	bulkResponse, err := bulkRequest.Do(ctx)
+	observeBulk("insert", actions, start, bulkResponse, err)
 	if err != nil {
 		return fmt.Errorf("bulkInsertItems: couldn't do bulk insert: %v", err)
 	}
 	if bulkResponse != nil && bulkResponse.Errors {
 		return fmt.Errorf("bulkInsertItems: bulk insert had errors")
 	}
-	if _, err := db.client.Refresh(db.index).Do(context.Background()); err != nil { // force instantly searchable
+	if _, err := db.client.Refresh(db.index).Do(ctx); err != nil { // force instantly searchable
 		return fmt.Errorf("bulkInsertItems: index refresh had error: %v", err)
 	}
 	return nil
 }
 
-func (db db) search(searchTerm string, loc location) ([]item, error) {
+// mustDocuments returns every document on db.index by id
+func (db db) mustDocuments() map[string]item {
+	docs, err := db.documents(context.Background())
+	if err != nil {
+		fatal(err.Error())
+	}
+	return docs
+}
+
+// documents scrolls through every document on db.index and returns them by id
+func (db db) documents(ctx context.Context) (_ map[string]item, err error) {
+	ctx, span := startSpan(ctx, "db.documents", spanKindInternal)
+	defer func() { span.end(err) }()
+	var (
+		docs   = make(map[string]item)
+		scroll = db.client.Scroll(db.index).Size(1000)
+	)
+	defer scroll.Clear(context.WithoutCancel(ctx))
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			span.setAttr("documents", len(docs))
+			return docs, nil
+		}
+		if err != nil {
+			return docs, fmt.Errorf("documents: error scrolling through index: %v", err)
+		}
+		for _, hit := range res.Hits.Hits {
+			var it item
+			if err := json.Unmarshal(*hit.Source, &it); err != nil {
+				return docs, fmt.Errorf("documents: error unmarshalling document %v: %v", hit.Id, err)
+			}
+			docs[hit.Id] = it
+		}
+	}
+}
+
+// esTimeoutShare is the share of a search's deadline that ES gets as its own timeout, so that it returns the hits
+// it found so far (with timed_out) rather than the request running out of time with none
+const esTimeoutShare = 0.8
+
+func (db db) search(ctx context.Context, searchTerm string, loc location) (_ searchResult, err error) {
+	ctx, span := startSpan(ctx, "db.search", spanKindInternal)
+	defer func() { span.end(err) }()
 	var (
 		items = make([]item, 0)
 		q     = elastic.NewFunctionScoreQuery()
@@ -159,22 +388,221 @@ func (db db) search(searchTerm string, loc location) ([]item, error) {
 	// relevant as it moves away from the specified location, following a gaussian bell curve
 	q.ScoreMode("multiply") // Illustrative as it's the default
 
-	searchResult, err := db.client.Search().Index(db.index).Query(q).Size(20).Do(context.Background())
+	search := db.client.Search().Index(db.index).Query(q).Size(20)
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := int(float64(time.Until(deadline).Milliseconds()) * esTimeoutShare)
+		search = search.TimeoutInMillis(max(ms, 1))
+	}
+	start := time.Now()
+	res, err := search.Do(ctx)
+	esDuration.observeSince(start, "search")
 	if err != nil {
-		err = fmt.Errorf("search: error executing search query: %v", err)
-		log.Println(err)
-		return items, err
+		esErrors.inc("search")
+		if ctxErr := ctx.Err(); ctxErr != nil { // e.g. the deadline, rather than ES, failed the search
+			err = fmt.Errorf("search: %w: %v", ctxErr, err)
+		} else {
+			err = fmt.Errorf("search: %w: error executing search query: %v", errStoreUnavailable, err)
+		}
+		slog.ErrorContext(ctx, err.Error())
+		return searchResult{items: items}, err
 	}
 
-	for _, hit := range searchResult.Hits.Hits {
+	span.setAttr("hits", len(res.Hits.Hits))
+	span.setAttr("timed_out", res.TimedOut)
+	var (
+		ids    = make([]string, 0, len(res.Hits.Hits))
+		scores = make([]float64, 0, len(res.Hits.Hits))
+	)
+	for _, hit := range res.Hits.Hits {
 		var it item
 		if err := json.Unmarshal(*hit.Source, &it); err != nil {
-			err = fmt.Errorf("search: error unmarshalling search query result: %v", err)
-			log.Println(err)
-			return items, err
+			err = fmt.Errorf("search: %w: error unmarshalling search query result: %v", errStoreUnavailable, err)
+			slog.ErrorContext(ctx, err.Error())
+			return searchResult{items: items}, err
 		}
 		items = append(items, it)
+		ids = append(ids, hit.Id)
+		if hit.Score != nil {
+			scores = append(scores, *hit.Score)
+		}
+	}
+	if len(scores) != len(ids) { // e.g. sorted by something else than _score
+		scores = nil
+	}
+	if res.TimedOut {
+		slog.WarnContext(ctx, "search: timed out on ES, returning partial results", "hits", len(items))
 	}
 
+	return searchResult{items: items, ids: ids, scores: scores, timedOut: res.TimedOut}, nil
+}
+
+// generation identifies the index behind db.index by name and uuid, so that it changes whenever the index is
+// replaced, whether recreated or swapped behind an alias by a reindex
+func (db db) generation(ctx context.Context) (_ string, err error) {
+	ctx, span := startSpan(ctx, "db.generation", spanKindInternal)
+	defer func() { span.end(err) }()
+	res, err := db.client.IndexGetSettings(db.index).Name("index.uuid").FlatSettings(true).Do(ctx)
+	if err != nil {
+		return "", fmt.Errorf("generation: %w: error getting index settings: %v", errStoreUnavailable, err)
+	}
+	var indices []string
+	for name, settings := range res {
+		indices = append(indices, fmt.Sprintf("%v/%v", name, settings.Settings["index.uuid"]))
+	}
+	sort.Strings(indices)
+	return strings.Join(indices, ","), nil
+}
+
+// storeFailure is what a failed ES call of ctx is reported as: the error of ctx if it's done, e.g. past the
+// request's deadline, or errStoreUnavailable
+func storeFailure(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errStoreUnavailable
+}
+
+// get is a real-time GET by _id, so it sees writes before db.index is refreshed, unlike a search
+func (db db) get(ctx context.Context, id string) (_ item, err error) {
+	ctx, span := startSpan(ctx, "db.get", spanKindInternal)
+	defer func() { span.end(err) }()
+	span.setAttr("id", id)
+	var it item
+	res, err := db.client.Get().Index(db.index).Type(db.version.docType()).Id(id).Realtime(true).Do(ctx)
+	if elastic.IsNotFound(err) || (err == nil && !res.Found) {
+		return it, errItemNotFound
+	}
+	if err != nil {
+		return it, fmt.Errorf("get: %w: error getting item %v: %v", storeFailure(ctx), id, err)
+	}
+	if err := json.Unmarshal(*res.Source, &it); err != nil {
+		return it, fmt.Errorf("get: %w: error unmarshalling item %v: %v", errStoreUnavailable, id, err)
+	}
+	return it, nil
+}
+
+// getVersion is a real-time GET by _id, like get, that also reads the _seq_no and _primary_term of the item, which
+// the client's GetService doesn't decode
+func (db db) getVersion(ctx context.Context, id string) (_ item, _ itemVersion, err error) {
+	ctx, span := startSpan(ctx, "db.getVersion", spanKindInternal)
+	defer func() { span.end(err) }()
+	span.setAttr("id", id)
+	var it item
+	res, err := db.client.PerformRequest(ctx, elastic.PerformRequestOptions{Method: "GET", Path: db.docPath(id),
+		Params: url.Values{"realtime": {"true"}}, IgnoreErrors: []int{http.StatusNotFound}})
+	if err != nil {
+		return it, itemVersion{}, fmt.Errorf("getVersion: %w: error getting item %v: %v", storeFailure(ctx), id, err)
+	}
+	var doc struct {
+		Found       bool             `json:"found"`
+		SeqNo       int64            `json:"_seq_no"`
+		PrimaryTerm int64            `json:"_primary_term"`
+		Source      *json.RawMessage `json:"_source"`
+	}
+	if err := json.Unmarshal(res.Body, &doc); err != nil {
+		return it, itemVersion{}, fmt.Errorf("getVersion: %w: error unmarshalling item %v: %v", errStoreUnavailable, id, err)
+	}
+	if !doc.Found {
+		return it, itemVersion{}, errItemNotFound
+	}
+	if doc.Source == nil {
+		return it, itemVersion{}, fmt.Errorf("getVersion: %w: item %v has no _source", errStoreUnavailable, id)
+	}
+	if err := json.Unmarshal(*doc.Source, &it); err != nil {
+		return it, itemVersion{}, fmt.Errorf("getVersion: %w: error unmarshalling item %v: %v", errStoreUnavailable, id, err)
+	}
+	return it, itemVersion{seqNo: doc.SeqNo, primaryTerm: doc.PrimaryTerm}, nil
+}
+
+// getMany gets the items with the ids in a single mget, leaving out the ones that aren't on db.index
+func (db db) getMany(ctx context.Context, ids []string) (_ map[string]item, err error) {
+	ctx, span := startSpan(ctx, "db.getMany", spanKindInternal)
+	defer func() { span.end(err) }()
+	span.setAttr("ids", len(ids))
+	mget := db.client.Mget()
+	for _, id := range ids {
+		mget = mget.Add(elastic.NewMultiGetItem().Index(db.index).Type(db.version.bulkType()).Id(id))
+	}
+	res, err := mget.Do(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMany: %w: error getting %v items: %v", storeFailure(ctx), len(ids), err)
+	}
+	items := make(map[string]item, len(res.Docs))
+	for _, doc := range res.Docs {
+		if doc.Error != nil {
+			return nil, fmt.Errorf("getMany: %w: error getting item %v: %v", errStoreUnavailable, doc.Id, doc.Error.Reason)
+		}
+		if !doc.Found {
+			continue
+		}
+		var it item
+		if err := json.Unmarshal(*doc.Source, &it); err != nil {
+			return nil, fmt.Errorf("getMany: %w: error unmarshalling item %v: %v", errStoreUnavailable, doc.Id, err)
+		}
+		items[doc.Id] = it
+	}
 	return items, nil
 }
+
+// create indexes the item with op_type=create, so that ES rather than a lookup first decides whether the id is taken,
+// and concurrent creates of the same id can't both succeed
+func (db db) create(ctx context.Context, id string, it item) (err error) {
+	ctx, span := startSpan(ctx, "db.create", spanKindInternal)
+	defer func() { span.end(err) }()
+	span.setAttr("id", id)
+	_, err = db.client.Index().Index(db.index).Type(db.version.docType()).Id(id).OpType("create").BodyJson(it).Do(ctx)
+	if elastic.IsConflict(err) {
+		return errItemExists
+	}
+	if err != nil {
+		return fmt.Errorf("create: %w: error indexing item %v: %v", storeFailure(ctx), id, err)
+	}
+	return nil
+}
+
+func (db db) put(ctx context.Context, id string, it item) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "db.put", spanKindInternal)
+	defer func() { span.end(err) }()
+	span.setAttr("id", id)
+	res, err := db.client.Index().Index(db.index).Type(db.version.docType()).Id(id).BodyJson(it).Do(ctx)
+	if err != nil {
+		return false, fmt.Errorf("put: %w: error indexing item %v: %v", storeFailure(ctx), id, err)
+	}
+	return res.Result == "created", nil
+}
+
+// update indexes the item with if_seq_no and if_primary_term, so that ES rejects it with a version conflict if the
+// item was written or deleted since version was read. The client's IndexService can't send them, hence the raw request.
+func (db db) update(ctx context.Context, id string, it item, version itemVersion) (err error) {
+	ctx, span := startSpan(ctx, "db.update", spanKindInternal)
+	defer func() { span.end(err) }()
+	span.setAttr("id", id)
+	_, err = db.client.PerformRequest(ctx, elastic.PerformRequestOptions{Method: "PUT", Path: db.docPath(id), Body: it,
+		Params: url.Values{"if_seq_no": {strconv.FormatInt(version.seqNo, 10)}, "if_primary_term": {strconv.FormatInt(version.primaryTerm, 10)}}})
+	if elastic.IsConflict(err) {
+		return errItemChanged
+	}
+	if err != nil {
+		return fmt.Errorf("update: %w: error indexing item %v: %v", storeFailure(ctx), id, err)
+	}
+	return nil
+}
+
+// docPath is the path of the document with that _id
+func (db db) docPath(id string) string {
+	return "/" + url.PathEscape(db.index) + "/" + db.version.docType() + "/" + url.PathEscape(id)
+}
+
+func (db db) delete(ctx context.Context, id string) (err error) {
+	ctx, span := startSpan(ctx, "db.delete", spanKindInternal)
+	defer func() { span.end(err) }()
+	span.setAttr("id", id)
+	_, err = db.client.Delete().Index(db.index).Type(db.version.docType()).Id(id).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return errItemNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("delete: %w: error deleting item %v: %v", storeFailure(ctx), id, err)
+	}
+	return nil
+}
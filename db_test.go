@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+func TestParseClusterVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		expected    clusterVersion
+		typeless    bool
+		expectedErr bool
+	}{
+		{name: "elasticsearch 6", body: `{"version":{"number":"6.4.0","build_flavor":"default"}}`, expected: clusterVersion{"elasticsearch", 6, "6.4.0"}},
+		{name: "elasticsearch 7", body: `{"version":{"number":"7.17.9","build_flavor":"default"}}`, expected: clusterVersion{"elasticsearch", 7, "7.17.9"}, typeless: true},
+		{name: "elasticsearch 8", body: `{"version":{"number":"8.11.1","build_flavor":"default"}}`, expected: clusterVersion{"elasticsearch", 8, "8.11.1"}, typeless: true},
+		{name: "opensearch", body: `{"version":{"distribution":"opensearch","number":"2.11.0"}}`, expected: clusterVersion{"opensearch", 2, "2.11.0"}, typeless: true},
+		{name: "elasticsearch 5 is unsupported", body: `{"version":{"number":"5.6.16"}}`, expectedErr: true},
+		{name: "unknown distribution", body: `{"version":{"distribution":"other","number":"1.0.0"}}`, expectedErr: true},
+		{name: "no version", body: `{"tagline":"You Know, for Search"}`, expectedErr: true},
+		{name: "not json", body: `<html>`, expectedErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := parseClusterVersion([]byte(tc.body))
+			if tc.expectedErr != (err != nil) {
+				t.Errorf("expected error %v but got %v", tc.expectedErr, err)
+				t.FailNow()
+			}
+			if tc.expectedErr {
+				return
+			}
+			if !reflect.DeepEqual(tc.expected, actual) {
+				t.Errorf("expected %#v but got %#v", tc.expected, actual)
+			}
+			if tc.typeless != actual.typeless() {
+				t.Errorf("expected typeless %v but got %v", tc.typeless, actual.typeless())
+			}
+		})
+	}
+}
+
+func TestMapping(t *testing.T) {
+	for _, v := range []clusterVersion{{"elasticsearch", 6, "6.4.0"}, {"elasticsearch", 8, "8.11.1"}, {"opensearch", 2, "2.11.0"}} {
+		var body struct {
+			Settings map[string]int                        `json:"settings"`
+			Mappings map[string]map[string]json.RawMessage `json:"mappings"`
+		}
+		if err := json.Unmarshal([]byte(mapping(v)), &body); err != nil {
+			t.Errorf("%v: mapping isn't valid json: %v", v, err)
+			continue
+		}
+		if body.Settings["number_of_shards"] != 5 {
+			t.Errorf("%v: expected 5 shards but got %v", v, body.Settings)
+		}
+		_, typed := body.Mappings["item"]
+		if typed == v.typeless() {
+			t.Errorf("%v: expected the mapping to be typed only for ES 6 but got %v", v, mapping(v))
+		}
+	}
+}
+
+// Search query test checks the exact query DSL db.search sends for a /search request, against a fakeES.
+func TestSearchQuery(t *testing.T) {
+	var (
+		es = newFakeES(fakeES6, t)
+		db = es.newDB("items", t)
+	)
+	loadItemsIntoTestIndex(`"camera",51,0,london/camera,[]`, false, db, t)
+	actualItems, actualStatusCode := testRequest("GET", "/search", "video cameras", "51.5", "-0.1", db, t)
+	if actualStatusCode != http.StatusOK || len(actualItems) != 1 {
+		t.Errorf("expected the camera but got %v %v", actualStatusCode, actualItems)
+	}
+
+	searches := es.received("POST", "/items/_search")
+	if len(searches) != 1 {
+		t.Errorf("expected 1 search but got %v", searches)
+		t.FailNow()
+	}
+	expected := `{
+		"query":{
+			"function_score":{
+				"functions":[{"gauss":{"location":{"offset":"5km","origin":{"lat":51.5,"lon":-0.1},"scale":"10km"}}}],
+				"query":{"multi_match":{"fields":["name","url","img_urls"],"query":"video cameras"}},
+				"score_mode":"multiply"
+			}
+		},
+		"size":20
+	}`
+	// ES gets most of what's left of the request's deadline as its timeout, which depends on how long the test took
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(searches[0].Body), &body); err != nil {
+		t.Errorf("expected a JSON search but got %v", searches[0].Body)
+		t.FailNow()
+	}
+	timeout, _ := body["timeout"].(string)
+	if ms, err := strconv.Atoi(strings.TrimSuffix(timeout, "ms")); err != nil || ms <= 0 || ms > 1600 {
+		t.Errorf("expected a timeout of up to 80%% of the 2s deadline but got %q", timeout)
+	}
+	delete(body, "timeout")
+	actual, _ := json.Marshal(body)
+	assertJSONEqual(expected, string(actual), t)
+}
+
+// Timeout test expects searches that outlive their deadline to fail with 504, and searches ES timed out to return
+// its partial hits, flagged with X-Timed-Out.
+func TestSearchTimeout(t *testing.T) {
+	tests := []struct {
+		name               string
+		searchDelay        time.Duration
+		searchTimedOut     bool
+		expectedStatusCode int
+		expectedTimedOut   string
+	}{
+		{name: "in time", expectedStatusCode: http.StatusOK},
+		{name: "timed out on ES", searchTimedOut: true, expectedStatusCode: http.StatusOK, expectedTimedOut: "true"},
+		{name: "past the deadline", searchDelay: time.Second, expectedStatusCode: http.StatusGatewayTimeout},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				es      = newFakeES(fakeES6, t)
+				db      = es.newDB("items", t)
+				handler = newEndpointHandler(db)
+				w       = httptest.NewRecorder()
+			)
+			loadItemsIntoTestIndex(`"camera",51,0,london/camera,[]`, false, db, t)
+			es.searchDelay, es.searchTimedOut = tc.searchDelay, tc.searchTimedOut
+			handler.searchTimeout = 50 * time.Millisecond
+			start := time.Now()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/search?searchTerm=camera&lat=51&lng=0", nil))
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %v but got %v", tc.expectedStatusCode, w.Code)
+			}
+			if actual := w.Header().Get("X-Timed-Out"); actual != tc.expectedTimedOut {
+				t.Errorf("expected X-Timed-Out %q but got %q", tc.expectedTimedOut, actual)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("expected the search to give up after its 50ms deadline but it took %v", elapsed)
+			}
+		})
+	}
+}
+
+// Search ids test expects searches to return the stable id of each item, for /v2/search.
+func TestSearchIDs(t *testing.T) {
+	var (
+		es = newFakeES(fakeES6, t)
+		db = es.newDB("items", t)
+	)
+	loadItemsIntoTestIndex(`"camera",51,0,london/hire-camera-28584820,[]`, false, db, t)
+	res, err := db.search(context.Background(), "camera", location{Lat: 51, Lon: 0})
+	if err != nil || !reflect.DeepEqual([]string{"28584820"}, res.ids) {
+		t.Errorf("expected the stable id of the camera but got %v %v", res.ids, err)
+	}
+}
+
+// Get many test expects a single mget of the ids, and only the items that exist.
+func TestGetMany(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		docs    string
+	}{
+		{name: "ES 6", version: fakeES6, docs: `[{"_index":"items","_type":"item","_id":"3"},{"_index":"items","_type":"item","_id":"7"},{"_index":"items","_type":"item","_id":"1"}]`},
+		{name: "ES 8", version: fakeES8, docs: `[{"_index":"items","_id":"3"},{"_index":"items","_id":"7"},{"_index":"items","_id":"1"}]`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				es = newFakeES(tc.version, t)
+				db = es.newDB("items", t)
+			)
+			loadItemsIntoTestIndex(`"camera",51,0,london/camera-1,[]
+"tripod",51,0,london/tripod-2,[]
+"lens",51,0,london/lens-3,[]`, false, db, t)
+			items, err := db.getMany(context.Background(), []string{"3", "7", "1"})
+			if err != nil {
+				t.Errorf("couldn't get items: %v", err)
+				t.FailNow()
+			}
+			if len(items) != 2 || items["1"].Name != "camera" || items["3"].Name != "lens" {
+				t.Errorf("expected the camera and the lens but got %v", items)
+			}
+			mgets := es.received("GET", "/_mget")
+			if len(mgets) != 1 {
+				t.Errorf("expected a single mget but got %v", mgets)
+				t.FailNow()
+			}
+			assertJSONEqual(`{"docs":`+tc.docs+`}`, mgets[0].Body, t)
+		})
+	}
+}
+
+// Write test expects creates to go to ES with op_type=create, so that ES answers whether the id is taken, puts to
+// report whether they created the item, and calls past their deadline to fail with it rather than as unavailable.
+func TestWrites(t *testing.T) {
+	var (
+		es     = newFakeES(fakeES8, t)
+		db     = es.newDB("items", t)
+		camera = item{"camera", location{51, 0}, "london/camera-1", []string{}}
+		ctx    = context.Background()
+	)
+	loadItemsIntoTestIndex(`"tripod",51,0,london/tripod-2,[]`, false, db, t)
+	if err := db.create(ctx, "1", camera); err != nil {
+		t.Errorf("couldn't create item: %v", err)
+	}
+	if err := db.create(ctx, "1", camera); !errors.Is(err, errItemExists) {
+		t.Errorf("expected creating an existing item to fail with errItemExists but got %v", err)
+	}
+	creates := es.received("PUT", "/items/_doc/1")
+	if len(creates) != 2 || creates[0].Query != "op_type=create" {
+		t.Errorf("expected 2 creates with op_type=create but got %v", creates)
+	}
+	for _, tc := range []struct {
+		id              string
+		expectedCreated bool
+	}{{"2", false}, {"3", true}} {
+		if created, err := db.put(ctx, tc.id, camera); err != nil || created != tc.expectedCreated {
+			t.Errorf("expected putting item %v to report created %v but got %v, %v", tc.id, tc.expectedCreated, created, err)
+		}
+	}
+	if it, err := db.get(ctx, "2"); err != nil || it.Name != "camera" {
+		t.Errorf("expected item 2 to be the camera but got %v, %v", it, err)
+	}
+	expired, cancel := context.WithTimeout(ctx, 0)
+	defer cancel()
+	if _, err := db.get(expired, "2"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a get past its deadline to fail with it but got %v", err)
+	}
+}
+
+// Refresh interval test expects the refresh interval to be set on the existing index, in milliseconds.
+func TestSetRefreshInterval(t *testing.T) {
+	var (
+		es = newFakeES(fakeES8, t)
+		db = es.newDB("items", t)
+	)
+	loadItemsIntoTestIndex(`"camera",51,0,london/camera,[]`, false, db, t)
+	if err := db.setRefreshInterval(context.Background(), 1500*time.Millisecond); err != nil {
+		t.Errorf("couldn't set the refresh interval: %v", err)
+		t.FailNow()
+	}
+	settings := es.received("PUT", "/items/_settings")
+	if len(settings) != 1 {
+		t.Errorf("expected the settings to be put once but got %v", settings)
+		t.FailNow()
+	}
+	assertJSONEqual(`{"index":{"refresh_interval":"1500ms"}}`, settings[0].Body, t)
+}
+
+// Invalid search test sends every invalid search of the /search contract through a db, and expects none of them
+// to reach ES.
+func TestInvalidSearchesDontReachES(t *testing.T) {
+	var (
+		es = newFakeES(fakeES6, t)
+		db = es.newDB("items", t)
+	)
+	loadItemsIntoTestIndex(`"camera",51,0,london/camera,[]`, false, db, t)
+	for _, tc := range searchTestCases {
+		if tc.expectedStatusCode != http.StatusBadRequest {
+			continue
+		}
+		if _, actual := testRequest(tc.httpMethod, tc.endpoint, tc.searchTerm, tc.lat, tc.lon, db, t); actual != http.StatusBadRequest {
+			t.Errorf("%v: expected status code %v but got %v", tc.name, http.StatusBadRequest, actual)
+		}
+	}
+	if searches := es.received("POST", "/_search"); len(searches) > 0 {
+		t.Errorf("expected no invalid search to reach ES but got %v", searches)
+	}
+}
+
+// Ingestion test checks the index creation and bulk actions of a full reload, on a typed and a typeless cluster.
+func TestReplaceIndex(t *testing.T) {
+	tests := []struct {
+		name         string
+		version      string
+		expectedType string
+	}{
+		{name: "ES 6", version: fakeES6, expectedType: "item"},
+		{name: "ES 8", version: fakeES8, expectedType: ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				es = newFakeES(tc.version, t)
+				db = es.newDB("items", t)
+			)
+			loadItemsIntoTestIndex(`"camera",51,0,london/camera-1,[]
+"tripod",51,0,london/tripod-2,[]`, false, db, t)
+
+			creates := es.received("PUT", "/items")
+			if len(creates) != 1 {
+				t.Errorf("expected the index to be created once but got %v", creates)
+				t.FailNow()
+			}
+			assertJSONEqual(mapping(db.version), creates[0].Body, t)
+
+			bulks := es.received("POST", "/_bulk")
+			if len(bulks) != 1 {
+				t.Errorf("expected 1 bulk request but got %v", bulks)
+				t.FailNow()
+			}
+			var lines = strings.Split(strings.TrimSpace(bulks[0].Body), "\n")
+			for i, expected := range []string{
+				`{"index":{"_index":"items","_id":"1","_type":"` + tc.expectedType + `"}}`,
+				`{"name":"camera","location":{"lat":51,"lon":0},"url":"london/camera-1","img_urls":[]}`,
+				`{"index":{"_index":"items","_id":"2","_type":"` + tc.expectedType + `"}}`,
+				`{"name":"tripod","location":{"lat":51,"lon":0},"url":"london/tripod-2","img_urls":[]}`,
+			} {
+				if tc.expectedType == "" {
+					expected = strings.Replace(expected, `,"_type":""`, "", 1)
+				}
+				if i >= len(lines) || lines[i] != expected {
+					t.Errorf("expected bulk line %v to be %v but got %v", i, expected, lines)
+				}
+			}
+
+			if _, err := db.documents(context.Background()); err != nil {
+				t.Errorf("couldn't scroll through the index: %v", err)
+			}
+			for _, search := range es.received("POST", "/items/_search") {
+				if typeless := strings.Contains(search.Query, "rest_total_hits_as_int=true"); typeless != db.version.typeless() {
+					t.Errorf("expected rest_total_hits_as_int only on typeless clusters but got %v", search.Query)
+				}
+			}
+		})
+	}
+}
+
+// Sync test against a fakeES, so that sync's diffing also runs without a cluster,
+// and so that a bulk item ES fails can fail the sync.
+func TestSyncHermetic(t *testing.T) {
+	testSync(newFakeES(fakeES6, t).newDB("items", t), t)
+
+	es := newFakeES(fakeES6, t)
+	db := es.newDB("items", t)
+	loadItemsIntoTestIndex(`"camera",51,0,london/camera-1,[]
+"tripod",51,0,london/tripod-2,[]`, false, db, t)
+	items, _ := readCSV(strings.NewReader(`"camera",51,0,london/camera-1,[]
+"tripod with head",51,0,london/tripod-2,[]
+"flash",51,0,london/flash-4,[]`))
+	es.bulkFailures = map[string]string{"4": "mapper_parsing_exception"}
+	if _, err := db.sync(context.Background(), items); err == nil {
+		t.Errorf("expected sync to fail when adding an item failed but it didn't")
+	}
+	if docs := db.mustDocuments(); docs["2"].Name != "tripod with head" {
+		t.Errorf("expected the bulk items that didn't fail to be applied but got %v", docs)
+	}
+	if err := db.bulkInsertItems(context.Background(), items); err == nil {
+		t.Errorf("expected bulkInsertItems to fail when inserting an item failed but it didn't")
+	}
+}
+
+// Fake ES bulk test creates documents with the create op, which ES answers 409 for an existing id.
+func TestFakeESBulkCreate(t *testing.T) {
+	db := newFakeES(fakeES6, t).newDB("items", t)
+	loadItemsIntoTestIndex(`"camera",51,0,london/camera-1,[]`, false, db, t)
+	res, err := db.client.Bulk().
+		Add(elastic.NewBulkIndexRequest().OpType("create").Index(db.index).Type(db.version.bulkType()).Id("1").Doc(item{Name: "lens"})).
+		Add(elastic.NewBulkIndexRequest().OpType("create").Index(db.index).Type(db.version.bulkType()).Id("3").Doc(item{Name: "lens"})).
+		Do(context.Background())
+	if err != nil {
+		t.Errorf("couldn't do bulk create: %v", err)
+		t.FailNow()
+	}
+	if !res.Errors || len(res.Failed()) != 1 || res.Failed()[0].Id != "1" || res.Failed()[0].Status != http.StatusConflict {
+		t.Errorf("expected only the create of existing item 1 to fail with 409 but got %+v", res.Items)
+	}
+	if docs := db.mustDocuments(); docs["1"].Name != "camera" || docs["3"].Name != "lens" {
+		t.Errorf("expected item 1 to be kept and item 3 to be created but got %v", docs)
+	}
+}
+
+func assertJSONEqual(expected, actual string, t *testing.T) {
+	var e, a interface{}
+	if err := json.Unmarshal([]byte(expected), &e); err != nil {
+		t.Errorf("expected isn't valid json: %v", err)
+		t.FailNow()
+	}
+	if err := json.Unmarshal([]byte(actual), &a); err != nil {
+		t.Errorf("actual isn't valid json: %v", err)
+		t.FailNow()
+	}
+	if !reflect.DeepEqual(e, a) {
+		t.Errorf("expected %v but got %v", expected, actual)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"strconv"
 )
@@ -13,11 +12,11 @@ import (
 func mustReadCSVFromFile(path string) []item {
 	fh, err := os.Open(path)
 	if err != nil {
-		log.Fatalf("mustReadCSVFromFile: error opening file: %v", err)
+		fatal(fmt.Sprintf("mustReadCSVFromFile: error opening file: %v", err))
 	}
 	items, err := readCSV(fh)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err.Error())
 	}
 	return items
 }
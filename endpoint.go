@@ -1,50 +1,199 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type endpointHandler struct {
-	db db
+	store itemStore
+	// searchTimeout is the deadline of a search, past which it fails with 504
+	searchTimeout time.Duration
+	// itemTimeout is the deadline of a request to /items, past which it fails with 504; see withItemTimeout
+	itemTimeout time.Duration
+	// v1Deprecation and v1Sunset are the Deprecation and Sunset of v1 of the API, if any
+	v1Deprecation, v1Sunset time.Time
+	// validator checks the items written through /items, with the same rules as ingest
+	validator validator
 }
 
-func newEndpointHandler(db db) endpointHandler {
-	return endpointHandler{db}
+func newEndpointHandler(store itemStore) endpointHandler {
+	return endpointHandler{store: store, searchTimeout: defaultConfig.SearchTimeout.Duration, itemTimeout: defaultConfig.ItemTimeout.Duration,
+		validator: newValidator(defaultValidationConfig)}
 }
 
+// endpointRoutes are the endpoints of endpointHandler; cross-cutting concerns are middlewares, see main
+var endpointRoutes = newRouter(
+	route{method: http.MethodGet, pattern: "/search", handle: endpointHandler.searchV1}, // as shipped in the first apps
+	route{method: http.MethodGet, pattern: "/v1/search", handle: endpointHandler.searchV1},
+	route{method: http.MethodGet, pattern: "/v2/search", handle: endpointHandler.searchV2},
+	route{method: http.MethodGet, pattern: "/items", handle: withItemTimeout(endpointHandler.getItems)},
+	route{method: http.MethodPost, pattern: "/items", handle: withItemTimeout(endpointHandler.createItem), middlewares: writeRoute},
+	route{method: http.MethodGet, pattern: "/items/{id}", handle: withItemTimeout(endpointHandler.getItem)},
+	route{method: http.MethodPut, pattern: "/items/{id}", handle: withItemTimeout(endpointHandler.replaceItem), middlewares: writeRoute},
+	route{method: http.MethodPatch, pattern: "/items/{id}", handle: withItemTimeout(endpointHandler.patchItem), middlewares: writeRoute},
+	route{method: http.MethodDelete, pattern: "/items/{id}", handle: withItemTimeout(endpointHandler.deleteItem), middlewares: writeRoute},
+	route{method: http.MethodGet, pattern: "/healthz", handle: endpointHandler.healthz},
+	route{method: http.MethodGet, pattern: "/readyz", handle: endpointHandler.readyz},
+	route{method: http.MethodGet, pattern: "/metrics", handle: func(_ endpointHandler, w http.ResponseWriter, r *http.Request) { serveMetrics(w, r) }},
+)
+
+// writeRoute is the middlewares of the routes that write items
+var writeRoute = []middleware{requireWriteScope}
+
 func (eh endpointHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	endpointRoutes.serveRoute(eh, w, r)
+}
+
+// searchV1 is /v1/search?searchTerm=...&lat=...&lng=..., and its alias /search: a JSON array of up to 20 items,
+// most relevant first. It's deprecated in favour of searchV2, but stays for the apps that can't be updated.
+func (eh endpointHandler) searchV1(w http.ResponseWriter, r *http.Request) {
+	if !eh.v1Deprecation.IsZero() {
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(eh.v1Deprecation.Unix(), 10))
+		w.Header().Set("Link", `</v2/search>; rel="successor-version"`)
+	}
+	if !eh.v1Sunset.IsZero() {
+		w.Header().Set("Sunset", eh.v1Sunset.Format(http.TimeFormat))
+	}
+	res, _, ok := eh.search(w, r, "v1")
+	if !ok {
 		return
 	}
-	if r.URL.Path != "/search" {
-		w.WriteHeader(http.StatusNotFound)
+	_ = json.NewEncoder(w).Encode(res.items)
+}
+
+// searchV2Item is an item in a v2 search: along with its stable id, and its distance from the search's location
+type searchV2Item struct {
+	ID string `json:"id"`
+	item
+	DistanceMeters float64 `json:"distance_m"`
+}
+
+// searchV2Response is the envelope of a v2 search, which leaves room for more than the items, e.g. paging
+type searchV2Response struct {
+	Items    []searchV2Item `json:"items"`
+	Count    int            `json:"count"`
+	TimedOut bool           `json:"timed_out"`
+}
+
+// searchV2 is /v2/search, with the same params as searchV1: the same items, enveloped, with their ids and distances
+func (eh endpointHandler) searchV2(w http.ResponseWriter, r *http.Request) {
+	res, loc, ok := eh.search(w, r, "v2")
+	if !ok {
 		return
 	}
+	body := searchV2Response{Items: make([]searchV2Item, len(res.items)), Count: len(res.items), TimedOut: res.timedOut}
+	for i, it := range res.items {
+		id := itemID(it) // the stable id of items of stores that don't know better
+		if i < len(res.ids) {
+			id = res.ids[i]
+		}
+		body.Items[i] = searchV2Item{ID: id, item: it, DistanceMeters: math.Round(distanceMeters(loc, it.Location))}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// search runs the search of r for every version of the API, and answers its errors itself, in which case ok is false
+func (eh endpointHandler) search(w http.ResponseWriter, r *http.Request, version string) (_ searchResult, _ location, ok bool) {
+	apiRequests.inc(version, r.URL.Path)
+	ctx, cancel := context.WithTimeout(r.Context(), eh.searchTimeout)
+	defer cancel()
+	ctx, span := startSpan(ctx, "endpointHandler.search", spanKindInternal)
 	var err error
-	searchTerm := r.URL.Query().Get("searchTerm")
-	if searchTerm == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	defer func() { span.end(err) }()
+	span.setAttr("api_version", version)
+	searchTerm, loc, problems := parseSearchParams(r.URL.Query())
+	if len(problems) > 0 {
+		writeError(w, r, http.StatusBadRequest, problems...)
+		return searchResult{}, loc, false
 	}
-	lat, err := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	span.setAttr("search_term", searchTerm)
+	span.setAttr("lat", loc.Lat)
+	span.setAttr("lng", loc.Lon)
+	res, err := eh.store.search(ctx, searchTerm, loc)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, r, http.StatusGatewayTimeout, apiError{Code: "timeout", Message: "the search took longer than " + eh.searchTimeout.String()})
+		return res, loc, false
+	case errors.Is(err, errStoreUnavailable):
+		writeError(w, r, http.StatusInternalServerError, apiError{Code: "store_unavailable", Message: "the search backend is unavailable"})
+		return res, loc, false
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, apiError{Code: "internal_error", Message: "the search failed"})
+		return res, loc, false
 	}
-	lng, err := strconv.ParseFloat(r.URL.Query().Get("lng"), 64)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	if res.timedOut { // partial results beat none, but clients need to know
+		w.Header().Set("X-Timed-Out", "true")
 	}
-	items, err := eh.db.search(searchTerm, location{Lat: lat, Lon: lng})
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	span.setAttr("results", len(res.items))
+	searchResults.add(float64(len(res.items)))
+	if len(res.items) == 0 {
+		zeroResultSearches.inc()
+	}
+	return res, loc, true
+}
+
+var (
+	// maxSearchTermLength and maxSearchTermTokens bound what a search sends to ES: the english analyzer and the
+	// match query's cost grow with every token
+	maxSearchTermLength = 200 // in characters
+	maxSearchTermTokens = 16  // whitespace separated words
+)
+
+// parseSearchParams reads and validates the params of /search, reporting every problem rather than just the first,
+// so that nothing that isn't a sensible search (NaN, lat=500, a pasted essay) reaches the store
+func parseSearchParams(q url.Values) (string, location, []apiError) {
+	var problems []apiError
+	searchTerm := q.Get("searchTerm")
+	if problem := searchTermProblem(searchTerm); problem != nil {
+		problems = append(problems, *problem)
+	}
+	coordinate := func(name string, limit float64) float64 {
+		v := q.Get(name)
+		if v == "" {
+			problems = append(problems, apiError{Code: "missing_parameter", Message: name + " is required", Field: name})
+			return 0
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		switch {
+		case err != nil || math.IsNaN(f) || math.IsInf(f, 0):
+			problems = append(problems, apiError{Code: "invalid_parameter", Message: name + " must be a finite number", Field: name})
+		case f < -limit || f > limit:
+			problems = append(problems, apiError{Code: "out_of_range", Message: fmt.Sprintf("%v must be between %v and %v", name, -limit, limit), Field: name})
+		}
+		return f
+	}
+	lat, lng := coordinate("lat", 90), coordinate("lng", 180)
+	return searchTerm, location{Lat: lat, Lon: lng}, problems
+}
+
+// searchTermProblem is what's wrong with searchTerm, if anything
+func searchTermProblem(searchTerm string) *apiError {
+	problem := func(code, message string) *apiError {
+		return &apiError{Code: code, Message: message, Field: "searchTerm"}
 	}
-	if err := json.NewEncoder(w).Encode(items); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	switch {
+	case strings.TrimSpace(searchTerm) == "":
+		return problem("missing_parameter", "searchTerm is required")
+	case !utf8.ValidString(searchTerm):
+		return problem("invalid_parameter", "searchTerm must be valid UTF-8")
+	case strings.IndexFunc(searchTerm, unicode.IsControl) >= 0:
+		return problem("invalid_parameter", "searchTerm can't contain control characters")
+	case utf8.RuneCountInString(searchTerm) > maxSearchTermLength:
+		return problem("too_long", fmt.Sprintf("searchTerm can't be longer than %v characters", maxSearchTermLength))
+	case len(strings.Fields(searchTerm)) > maxSearchTermTokens:
+		return problem("too_many_tokens", fmt.Sprintf("searchTerm can't have more than %v words", maxSearchTermTokens))
 	}
+	return nil
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeStore is an itemStore that records searches and returns canned results, for testing the HTTP layer
+type fakeStore struct {
+	items        []item
+	err          error
+	searches     []string
+	generationID string
+}
+
+func (s *fakeStore) search(ctx context.Context, searchTerm string, loc location) (searchResult, error) {
+	s.searches = append(s.searches, fmt.Sprintf("%v@%v,%v", searchTerm, loc.Lat, loc.Lon))
+	return searchResult{items: s.items}, s.err
+}
+func (s *fakeStore) get(ctx context.Context, id string) (item, error)          { return item{}, errItemNotFound }
+func (s *fakeStore) create(ctx context.Context, id string, it item) error      { return s.err }
+func (s *fakeStore) put(ctx context.Context, id string, it item) (bool, error) { return false, s.err }
+func (s *fakeStore) delete(ctx context.Context, id string) error               { return errItemNotFound }
+func (s *fakeStore) generation(ctx context.Context) (string, error)            { return s.generationID, nil }
+func (s *fakeStore) getMany(ctx context.Context, ids []string) (map[string]item, error) {
+	return nil, s.err
+}
+func (s *fakeStore) getVersion(ctx context.Context, id string) (item, itemVersion, error) {
+	return item{}, itemVersion{}, errItemNotFound
+}
+func (s *fakeStore) update(ctx context.Context, id string, it item, version itemVersion) error {
+	return s.err
+}
+
+// Handler test checks the /search contract against a fakeStore, without a cluster.
+func TestEndpointHandler(t *testing.T) {
+	var (
+		camera = item{"camera", location{51, 0}, "london/camera", []string{}}
+		ts     = []struct {
+			name               string
+			store              *fakeStore
+			httpMethod         string
+			target             string
+			expected           []item
+			expectedSearches   []string
+			expectedStatusCode int
+			expectedErrors     []apiError
+		}{
+			{
+				name:               "happy case",
+				store:              &fakeStore{items: []item{camera}},
+				httpMethod:         "GET",
+				target:             "/search?searchTerm=camera&lat=51&lng=0",
+				expected:           []item{camera},
+				expectedSearches:   []string{"camera@51,0"},
+				expectedStatusCode: http.StatusOK,
+			},
+			{
+				name:               "no results is an empty list",
+				store:              &fakeStore{items: []item{}},
+				httpMethod:         "GET",
+				target:             "/search?searchTerm=camera&lat=51&lng=0",
+				expected:           []item{},
+				expectedSearches:   []string{"camera@51,0"},
+				expectedStatusCode: http.StatusOK,
+			},
+			{
+				name:               "POST method not allowed",
+				store:              &fakeStore{},
+				httpMethod:         "POST",
+				target:             "/search?searchTerm=camera&lat=51&lng=0",
+				expectedStatusCode: http.StatusMethodNotAllowed,
+				expectedErrors:     []apiError{{Code: "method_not_allowed", Message: "POST isn't allowed, only GET"}},
+			},
+			{
+				name:               "different endpoint not found",
+				store:              &fakeStore{},
+				httpMethod:         "GET",
+				target:             "/differentEndpoint?searchTerm=camera&lat=51&lng=0",
+				expectedStatusCode: http.StatusNotFound,
+				expectedErrors:     []apiError{{Code: "not_found", Message: "/differentEndpoint doesn't exist"}},
+			},
+			{
+				name:               "empty search term returns Bad Request",
+				store:              &fakeStore{},
+				httpMethod:         "GET",
+				target:             "/search?searchTerm=&lat=51&lng=0",
+				expectedStatusCode: http.StatusBadRequest,
+				expectedErrors:     []apiError{{Code: "missing_parameter", Message: "searchTerm is required", Field: "searchTerm"}},
+			},
+			{
+				name:               "incorrect latitude returns Bad Request",
+				store:              &fakeStore{},
+				httpMethod:         "GET",
+				target:             "/search?searchTerm=camera&lat=not+a+lat&lng=0",
+				expectedStatusCode: http.StatusBadRequest,
+				expectedErrors:     []apiError{{Code: "invalid_parameter", Message: "lat must be a finite number", Field: "lat"}},
+			},
+			{
+				name:               "every bad param is reported at once",
+				store:              &fakeStore{},
+				httpMethod:         "GET",
+				target:             "/search?lat=north",
+				expectedStatusCode: http.StatusBadRequest,
+				expectedErrors: []apiError{
+					{Code: "missing_parameter", Message: "searchTerm is required", Field: "searchTerm"},
+					{Code: "invalid_parameter", Message: "lat must be a finite number", Field: "lat"},
+					{Code: "missing_parameter", Message: "lng is required", Field: "lng"},
+				},
+			},
+			{
+				name:               "store failure returns Internal Server Error",
+				store:              &fakeStore{err: fmt.Errorf("search: %w: boom", errStoreUnavailable)},
+				httpMethod:         "GET",
+				target:             "/search?searchTerm=camera&lat=51&lng=0",
+				expectedSearches:   []string{"camera@51,0"},
+				expectedStatusCode: http.StatusInternalServerError,
+				expectedErrors:     []apiError{{Code: "store_unavailable", Message: "the search backend is unavailable"}},
+			},
+			{
+				name:               "other failure returns Internal Server Error",
+				store:              &fakeStore{err: fmt.Errorf("boom")},
+				httpMethod:         "GET",
+				target:             "/search?searchTerm=camera&lat=51&lng=0",
+				expectedSearches:   []string{"camera@51,0"},
+				expectedStatusCode: http.StatusInternalServerError,
+				expectedErrors:     []apiError{{Code: "internal_error", Message: "the search failed"}},
+			},
+		}
+	)
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				w   = httptest.NewRecorder()
+				req = httptest.NewRequest(tc.httpMethod, tc.target, nil)
+			)
+			logRequests(newEndpointHandler(tc.store)).ServeHTTP(w, req)
+			if tc.expectedStatusCode != w.Code {
+				t.Fatalf("expected status code %v but got %v", tc.expectedStatusCode, w.Code)
+			}
+			if !reflect.DeepEqual(tc.expectedSearches, tc.store.searches) {
+				t.Errorf("expected searches %v but got %v", tc.expectedSearches, tc.store.searches)
+			}
+			if w.Code != http.StatusOK {
+				var body errorBody
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+					t.Fatalf("couldn't read response payload into an error: %v", err)
+				}
+				if !reflect.DeepEqual(tc.expectedErrors, body.Errors) || body.apiError != tc.expectedErrors[0] {
+					t.Errorf("expected errors %v but got %v", tc.expectedErrors, body)
+				}
+				if body.RequestID == "" || body.RequestID != w.Header().Get("X-Request-ID") {
+					t.Errorf("expected the request id %q but got %q", w.Header().Get("X-Request-ID"), body.RequestID)
+				}
+				return
+			}
+			var actual []item
+			if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+				t.Fatalf("couldn't read response payload into items: %v", err)
+			}
+			if !reflect.DeepEqual(tc.expected, actual) {
+				t.Errorf("expected %v but got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+// Search params test checks every validation rule of /search params, one bad param at a time.
+func TestParseSearchParams(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		expected      location
+		expectedCodes map[string]string // field to error code
+	}{
+		{name: "valid", query: "searchTerm=camera&lat=51.5&lng=-0.12", expected: location{Lat: 51.5, Lon: -0.12}},
+		{name: "edges of the ranges", query: "searchTerm=camera&lat=-90&lng=180", expected: location{Lat: -90, Lon: 180}},
+		{name: "unicode term", query: "searchTerm=caméra+vidéo&lat=0&lng=0"},
+		{name: "missing everything", query: "", expectedCodes: map[string]string{"searchTerm": "missing_parameter", "lat": "missing_parameter", "lng": "missing_parameter"}},
+		{name: "whitespace term", query: "searchTerm=+++&lat=0&lng=0", expectedCodes: map[string]string{"searchTerm": "missing_parameter"}},
+		{name: "NaN", query: "searchTerm=camera&lat=NaN&lng=nan", expectedCodes: map[string]string{"lat": "invalid_parameter", "lng": "invalid_parameter"}},
+		{name: "infinity", query: "searchTerm=camera&lat=Inf&lng=-Infinity", expectedCodes: map[string]string{"lat": "invalid_parameter", "lng": "invalid_parameter"}},
+		{name: "overflow", query: "searchTerm=camera&lat=1e400&lng=0", expectedCodes: map[string]string{"lat": "invalid_parameter"}},
+		{name: "not a number", query: "searchTerm=camera&lat=51N&lng=0", expectedCodes: map[string]string{"lat": "invalid_parameter"}},
+		{name: "latitude out of range", query: "searchTerm=camera&lat=500&lng=0", expectedCodes: map[string]string{"lat": "out_of_range"}},
+		{name: "longitude out of range", query: "searchTerm=camera&lat=0&lng=-180.5", expectedCodes: map[string]string{"lng": "out_of_range"}},
+		{name: "longest term", query: "searchTerm=" + strings.Repeat("é", maxSearchTermLength) + "&lat=0&lng=0"},
+		{name: "term too long", query: "searchTerm=" + strings.Repeat("é", maxSearchTermLength+1) + "&lat=0&lng=0", expectedCodes: map[string]string{"searchTerm": "too_long"}},
+		{name: "most tokens", query: "searchTerm=" + strings.Repeat("a+", maxSearchTermTokens) + "&lat=0&lng=0"},
+		{name: "too many tokens", query: "searchTerm=" + strings.Repeat("a+", maxSearchTermTokens+1) + "&lat=0&lng=0", expectedCodes: map[string]string{"searchTerm": "too_many_tokens"}},
+		{name: "control character", query: "searchTerm=camera%00&lat=0&lng=0", expectedCodes: map[string]string{"searchTerm": "invalid_parameter"}},
+		{name: "newline", query: "searchTerm=camera%0Alens&lat=0&lng=0", expectedCodes: map[string]string{"searchTerm": "invalid_parameter"}},
+		{name: "invalid UTF-8", query: "searchTerm=camera%FF&lat=0&lng=0", expectedCodes: map[string]string{"searchTerm": "invalid_parameter"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatalf("bad query %q: %v", tc.query, err)
+			}
+			_, loc, problems := parseSearchParams(q)
+			actualCodes := make(map[string]string)
+			for _, p := range problems {
+				actualCodes[p.Field] = p.Code
+			}
+			if len(tc.expectedCodes) == 0 && len(actualCodes) == 0 {
+				if loc != tc.expected {
+					t.Errorf("expected %v but got %v", tc.expected, loc)
+				}
+				return
+			}
+			if !reflect.DeepEqual(tc.expectedCodes, actualCodes) {
+				t.Errorf("expected problems %v but got %v", tc.expectedCodes, problems)
+			}
+		})
+	}
+}
+
+// API versions test expects /search and /v1/search to keep the v1 contract, with its deprecation headers once
+// they're configured, and /v2/search to envelope the same items with their ids and distances.
+func TestAPIVersions(t *testing.T) {
+	var (
+		camera  = item{"camera", location{51, 0}, "london/hire-camera-28584820", []string{}}
+		lens    = item{"lens", location{51.1, 0}, "london/hire-lens", []string{}}
+		handler = newEndpointHandler(&fakeStore{items: []item{camera, lens}})
+	)
+	undated := httptest.NewRecorder()
+	handler.ServeHTTP(undated, httptest.NewRequest("GET", "/v1/search?searchTerm=camera&lat=51&lng=0", nil))
+	if deprecation, sunset := undated.Header().Get("Deprecation"), undated.Header().Get("Sunset"); deprecation != "" || sunset != "" {
+		t.Errorf("expected no Deprecation or Sunset until they're configured but got %q and %q", deprecation, sunset)
+	}
+	handler.v1Deprecation = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+	handler.v1Sunset = time.Date(2027, time.June, 30, 0, 0, 0, 0, time.UTC)
+	for _, path := range []string{"/search", "/v1/search"} {
+		var (
+			w      = httptest.NewRecorder()
+			before = apiRequests.value("v1", path)
+		)
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path+"?searchTerm=camera&lat=51&lng=0", nil))
+		var actual []item
+		if err := json.NewDecoder(w.Body).Decode(&actual); w.Code != http.StatusOK || err != nil || !reflect.DeepEqual([]item{camera, lens}, actual) {
+			t.Errorf("%v: expected the v1 array of items but got %v %v", path, w.Code, actual)
+		}
+		for header, expected := range map[string]string{"Deprecation": "@1792281600", "Sunset": "Wed, 30 Jun 2027 00:00:00 GMT", "Link": `</v2/search>; rel="successor-version"`} {
+			if actual := w.Header().Get(header); actual != expected {
+				t.Errorf("%v: expected %v %q but got %q", path, header, expected, actual)
+			}
+		}
+		if actual := apiRequests.value("v1", path) - before; actual != 1 {
+			t.Errorf("%v: expected 1 v1 request to be counted but got %v", path, actual)
+		}
+	}
+
+	var (
+		w      = httptest.NewRecorder()
+		before = apiRequests.value("v2", "/v2/search")
+	)
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v2/search?searchTerm=camera&lat=51&lng=0", nil))
+	expected := `{"items":[
+		{"id":"28584820","name":"camera","location":{"lat":51,"lon":0},"url":"london/hire-camera-28584820","img_urls":[],"distance_m":0},
+		{"id":"` + itemID(lens) + `","name":"lens","location":{"lat":51.1,"lon":0},"url":"london/hire-lens","img_urls":[],"distance_m":11119}
+	],"count":2,"timed_out":false}`
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %v but got %v", http.StatusOK, w.Code)
+	}
+	assertJSONEqual(expected, w.Body.String(), t)
+	if actual := w.Header().Get("Deprecation"); actual != "" {
+		t.Errorf("expected v2 not to be deprecated but got %q", actual)
+	}
+	if actual := apiRequests.value("v2", "/v2/search") - before; actual != 1 {
+		t.Errorf("expected 1 v2 request to be counted but got %v", actual)
+	}
+}
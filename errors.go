@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// apiError is a problem with a request, e.g. {"code": "invalid_parameter", "message": "lat must be a finite number",
+// "field": "lat"}. Codes are stable, for clients to act on; messages are for humans. Field is the query param at
+// fault, if any.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field"`
+}
+
+// errorBody is the JSON body of every 4xx and 5xx response: the first problem, the request id to find it in the
+// logs with, and every problem, so that a client can fix them all at once
+type errorBody struct {
+	apiError
+	RequestID string     `json:"request_id"`
+	Errors    []apiError `json:"errors"`
+}
+
+// writeError answers status with the errorBody of problems, of which there must be at least one
+func writeError(w http.ResponseWriter, r *http.Request, status int, problems ...apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorBody{apiError: problems[0], RequestID: requestIDFrom(r.Context()), Errors: problems})
+}
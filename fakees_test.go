@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeES is an in-memory fake of the Elasticsearch endpoints db uses (index exists/create/delete, bulk, refresh,
+// search, scroll, count, settings, cluster health, mget and single document get/index/create/delete, with if_seq_no),
+// on an httptest.Server. It records every request it gets, so that tests can assert on the exact query DSL and bulk
+// actions db sends, without a cluster.
+// Search doesn't score: a term query filters documents by a field, anything else matches every document.
+type fakeES struct {
+	*httptest.Server
+	version string // body of GET /
+	health  string // status of GET /_cluster/health; green by default
+	// searchDelay is how long searches take, or until the client gives up; searchTimedOut makes them report timed_out
+	searchDelay    time.Duration
+	searchTimedOut bool
+	// searchFailures is how many of the next searches fail with 503, like a node going down
+	searchFailures int
+	// afterGet is called, with mu held, after every GET of a document that exists, e.g. to write it concurrently
+	afterGet func(index *fakeESIndex, id string)
+	// bulkFailures fails the bulk actions on these _ids with an item error of the given type, leaving the rest applied
+	bulkFailures map[string]string
+
+	mu       sync.Mutex
+	requests []fakeESRequest
+	indices  map[string]*fakeESIndex
+	seq      int // for generated _ids
+}
+
+type fakeESRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Body   string
+	Header http.Header
+}
+
+type fakeESIndex struct {
+	uuid    string
+	mapping string
+	ids     []string // in insertion order, which is the order searches return documents in
+	docs    map[string]map[string]interface{}
+	seqNos  map[string]int64 // of every document: the writes of the index when it was last written
+	writes  int64
+}
+
+const (
+	fakeES6 = `{"version":{"number":"6.4.0"}}`
+	fakeES8 = `{"version":{"number":"8.11.1"}}`
+)
+
+// newFakeES starts a fakeES that reports version (e.g. fakeES6) on GET /; it's closed at the end of the test
+func newFakeES(version string, t *testing.T) *fakeES {
+	es := &fakeES{version: version, health: "green", indices: make(map[string]*fakeESIndex)}
+	es.Server = httptest.NewServer(es)
+	t.Cleanup(es.Close)
+	return es
+}
+
+// newDB connects a db to the fakeES
+func (es *fakeES) newDB(index string, t *testing.T) db {
+	db, err := newDB(es.URL, "elastic", "changeme", index, nil, 5*time.Second, defaultConfig.esResilience())
+	if err != nil {
+		t.Errorf("can't connect to fake ES: %v", err)
+		t.FailNow()
+	}
+	t.Cleanup(db.client.Stop)
+	return db
+}
+
+// received returns the requests received so far whose path ends with pathSuffix (e.g. /_search)
+func (es *fakeES) received(method, pathSuffix string) []fakeESRequest {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	var reqs []fakeESRequest
+	for _, req := range es.requests {
+		if req.Method == method && strings.HasSuffix(req.Path, pathSuffix) {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+func (es *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if strings.HasSuffix(r.URL.Path, "/_search") {
+		select {
+		case <-time.After(es.searchDelay):
+		case <-r.Context().Done():
+		}
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.requests = append(es.requests, fakeESRequest{r.Method, r.URL.Path, r.URL.RawQuery, string(body), r.Header})
+	w.Header().Set("Content-Type", "application/json")
+
+	var (
+		path  = strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		index = es.indices[path[0]]
+	)
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/_search") && es.searchFailures > 0:
+		es.searchFailures--
+		fakeESError(w, http.StatusServiceUnavailable, "node_not_available")
+	case r.URL.Path == "/":
+		fmt.Fprint(w, es.version)
+	case r.URL.Path == "/_cluster/health":
+		fmt.Fprintf(w, `{"cluster_name":"fake","status":%q}`, es.health)
+	case path[0] == "_bulk":
+		es.bulk(w, body)
+	case path[0] == "_mget":
+		es.mget(w, body)
+	case r.URL.Path == "/_search/scroll" && r.Method == http.MethodDelete:
+		fmt.Fprint(w, `{"succeeded":true,"num_freed":1}`)
+	case r.URL.Path == "/_search/scroll": // every document came in the first page
+		fmt.Fprint(w, `{"_scroll_id":"fake","hits":{"total":0,"hits":[]}}`)
+	case len(path) == 1 && r.Method == http.MethodHead:
+		if index == nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case len(path) == 1 && r.Method == http.MethodPut:
+		if index != nil {
+			fakeESError(w, http.StatusBadRequest, "resource_already_exists_exception")
+			return
+		}
+		es.seq++
+		es.indices[path[0]] = &fakeESIndex{uuid: "uuid-" + strconv.Itoa(es.seq), mapping: string(body), docs: make(map[string]map[string]interface{})}
+		fmt.Fprintf(w, `{"acknowledged":true,"index":%q}`, path[0])
+	case index == nil:
+		fakeESError(w, http.StatusNotFound, "index_not_found_exception")
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		delete(es.indices, path[0])
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case path[1] == "_settings" && r.Method == http.MethodPut:
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case path[1] == "_settings":
+		fmt.Fprintf(w, `{%q:{"settings":{"index.uuid":%q}}}`, path[0], index.uuid)
+	case path[1] == "_refresh":
+		fmt.Fprint(w, `{"_shards":{"total":1,"successful":1,"failed":0}}`)
+	case path[1] == "_count":
+		fmt.Fprintf(w, `{"count":%v}`, len(index.ids))
+	case path[1] == "_search":
+		es.search(w, r, index, body)
+	case len(path) == 2 && r.Method == http.MethodPost:
+		es.seq++
+		index.put("generated-"+strconv.Itoa(es.seq), body)
+		fmt.Fprintf(w, `{"_index":%q,"_id":"generated-%v","result":"created"}`, path[0], es.seq)
+	case len(path) == 3 && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		_, exists := index.docs[path[2]]
+		if exists && r.URL.Query().Get("op_type") == "create" {
+			fakeESError(w, http.StatusConflict, "version_conflict_engine_exception")
+			return
+		}
+		if seqNo := r.URL.Query().Get("if_seq_no"); seqNo != "" && (!exists || seqNo != strconv.FormatInt(index.seqNos[path[2]], 10) || r.URL.Query().Get("if_primary_term") != "1") {
+			fakeESError(w, http.StatusConflict, "version_conflict_engine_exception")
+			return
+		}
+		index.put(path[2], body)
+		result := "created"
+		if exists {
+			result = "updated"
+		}
+		fmt.Fprintf(w, `{"_index":%q,"_id":%q,"result":%q}`, path[0], path[2], result)
+	case len(path) == 3 && r.Method == http.MethodGet:
+		doc, ok := index.docs[path[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"_index":%q,"_id":%q,"found":false}`, path[0], path[2])
+			return
+		}
+		source, _ := json.Marshal(doc)
+		fmt.Fprintf(w, `{"_index":%q,"_id":%q,"found":true,"_seq_no":%v,"_primary_term":1,"_source":%s}`, path[0], path[2], index.seqNos[path[2]], source)
+		if es.afterGet != nil {
+			es.afterGet(index, path[2])
+		}
+	case len(path) == 3 && r.Method == http.MethodDelete:
+		if !index.delete(path[2]) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"_index":%q,"_id":%q,"result":"not_found"}`, path[0], path[2])
+			return
+		}
+		fmt.Fprintf(w, `{"_index":%q,"_id":%q,"result":"deleted"}`, path[0], path[2])
+	default:
+		fakeESError(w, http.StatusBadRequest, "fake ES doesn't implement "+r.Method+" "+r.URL.Path)
+	}
+}
+
+// bulk applies index, create, update and delete actions, creating indices as needed like ES does.
+// Like ES, it reports "errors":true if any item has an error; a delete of a missing document isn't one.
+func (es *fakeES) bulk(w http.ResponseWriter, body []byte) {
+	var (
+		lines   = bufio.NewScanner(strings.NewReader(string(body)))
+		results []string
+		failed  bool
+	)
+	lines.Buffer(nil, len(body)+1)
+	for lines.Scan() {
+		var action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		if err := json.Unmarshal(lines.Bytes(), &action); err != nil || len(action) != 1 {
+			fakeESError(w, http.StatusBadRequest, "malformed bulk action: "+lines.Text())
+			return
+		}
+		for op, meta := range action {
+			var source []byte
+			if op != "delete" {
+				lines.Scan()
+				source = lines.Bytes()
+			}
+			index := es.indices[meta.Index]
+			if index == nil {
+				index = &fakeESIndex{docs: make(map[string]map[string]interface{})}
+				es.indices[meta.Index] = index
+			}
+			if meta.ID == "" {
+				es.seq++
+				meta.ID = "generated-" + strconv.Itoa(es.seq)
+			}
+			status, errorType := http.StatusOK, ""
+			switch {
+			case es.bulkFailures[meta.ID] != "":
+				status, errorType = http.StatusBadRequest, es.bulkFailures[meta.ID]
+			case op == "index":
+				index.put(meta.ID, source)
+			case op == "create":
+				if index.docs[meta.ID] != nil {
+					status, errorType = http.StatusConflict, "version_conflict_engine_exception"
+					break
+				}
+				status = http.StatusCreated
+				index.put(meta.ID, source)
+			case op == "update":
+				var update struct {
+					Doc map[string]interface{} `json:"doc"`
+				}
+				_ = json.Unmarshal(source, &update)
+				if index.docs[meta.ID] == nil {
+					status, errorType = http.StatusNotFound, "document_missing_exception"
+					break
+				}
+				for k, v := range update.Doc {
+					index.docs[meta.ID][k] = v
+				}
+			case op == "delete":
+				if !index.delete(meta.ID) {
+					status = http.StatusNotFound
+				}
+			}
+			result := fmt.Sprintf(`"_index":%q,"_id":%q,"status":%v`, meta.Index, meta.ID, status)
+			if errorType != "" {
+				failed = true
+				result += fmt.Sprintf(`,"error":{"type":%q,"reason":"[%v]: failed"}`, errorType, meta.ID)
+			}
+			results = append(results, fmt.Sprintf(`{%q:{%v}}`, op, result))
+		}
+	}
+	fmt.Fprintf(w, `{"took":1,"errors":%v,"items":[%v]}`, failed, strings.Join(results, ","))
+}
+
+// search returns the documents matching a term query, or every document, up to size.
+// Scrolls (i.e. ?scroll=) get every document in their first page.
+func (es *fakeES) search(w http.ResponseWriter, r *http.Request, index *fakeESIndex, body []byte) {
+	var req struct {
+		Size  *int `json:"size"`
+		Query struct {
+			Term map[string]interface{} `json:"term"`
+		} `json:"query"`
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			fakeESError(w, http.StatusBadRequest, "malformed search: "+err.Error())
+			return
+		}
+	}
+	size := 10
+	if req.Size != nil {
+		size = *req.Size
+	}
+	if s, err := strconv.Atoi(r.URL.Query().Get("size")); err == nil {
+		size = s
+	}
+	_, scroll := r.URL.Query()["scroll"]
+
+	var hits []string
+	for _, id := range index.ids {
+		if !scroll && len(hits) == size {
+			break
+		}
+		if !fakeESTermMatches(req.Query.Term, index.docs[id]) {
+			continue
+		}
+		source, _ := json.Marshal(index.docs[id])
+		hits = append(hits, fmt.Sprintf(`{"_id":%q,"_score":1,"_source":%s}`, id, source))
+	}
+	fmt.Fprintf(w, `{"_scroll_id":"fake","took":1,"timed_out":%v,"hits":{"total":%v,"max_score":1,"hits":[%v]}}`,
+		es.searchTimedOut, len(hits), strings.Join(hits, ","))
+}
+
+func fakeESTermMatches(term map[string]interface{}, doc map[string]interface{}) bool {
+	for field, value := range term {
+		if v, ok := value.(map[string]interface{}); ok {
+			value = v["value"]
+		}
+		if fmt.Sprint(doc[field]) != fmt.Sprint(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// mget returns the documents of an mget in order, with found set per document
+func (es *fakeES) mget(w http.ResponseWriter, body []byte) {
+	var req struct {
+		Docs []struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		} `json:"docs"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		fakeESError(w, http.StatusBadRequest, "malformed mget: "+err.Error())
+		return
+	}
+	var docs []string
+	for _, d := range req.Docs {
+		var doc map[string]interface{}
+		if index := es.indices[d.Index]; index != nil {
+			doc = index.docs[d.ID]
+		}
+		if doc == nil {
+			docs = append(docs, fmt.Sprintf(`{"_index":%q,"_id":%q,"found":false}`, d.Index, d.ID))
+			continue
+		}
+		source, _ := json.Marshal(doc)
+		docs = append(docs, fmt.Sprintf(`{"_index":%q,"_id":%q,"found":true,"_source":%s}`, d.Index, d.ID, source))
+	}
+	fmt.Fprintf(w, `{"docs":[%v]}`, strings.Join(docs, ","))
+}
+
+func (index *fakeESIndex) put(id string, source []byte) {
+	var doc map[string]interface{}
+	_ = json.Unmarshal(source, &doc)
+	if _, ok := index.docs[id]; !ok {
+		index.ids = append(index.ids, id)
+	}
+	index.docs[id] = doc
+	if index.seqNos == nil {
+		index.seqNos = make(map[string]int64)
+	}
+	index.seqNos[id] = index.writes
+	index.writes++
+}
+
+func (index *fakeESIndex) delete(id string) bool {
+	if _, ok := index.docs[id]; !ok {
+		return false
+	}
+	delete(index.docs, id)
+	delete(index.seqNos, id)
+	index.writes++
+	for i := range index.ids {
+		if index.ids[i] == id {
+			index.ids = append(index.ids[:i], index.ids[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+func fakeESError(w http.ResponseWriter, status int, reason string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"type":"fake_es_exception","reason":%q},"status":%v}`, reason, status)
+}
@@ -0,0 +1,122 @@
+package main
+
+import "math"
+
+// distanceMeters is the haversine (great-circle) distance between a and b
+func distanceMeters(a, b location) float64 {
+	const earthRadiusMeters = 6371000
+	var (
+		lat1, lat2 = a.Lat * math.Pi / 180, b.Lat * math.Pi / 180
+		dLat       = lat2 - lat1
+		dLon       = (b.Lon - a.Lon) * math.Pi / 180
+		h          = math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(h))
+}
+
+// gaussDecay is Elasticsearch's gauss decay function with decay 0.5:
+// 1 up to offset away from the origin, then a gaussian bell curve that is 0.5 at offset+scale.
+func gaussDecay(distance, offset, scale float64) float64 {
+	d := math.Max(0, distance-offset)
+	return math.Exp(-d * d * math.Ln2 / (scale * scale))
+}
+
+// geohashAlphabet is the base 32 of geohashes
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash encodes loc as a geohash of precision characters, i.e. the cell of a grid that loc is in.
+// Cells get about 32 times smaller with each character: 5 is about 4.9km by 4.9km, 6 is 1.2km by 0.6km.
+func geohash(loc location, precision int) string {
+	var (
+		lat, lon = [2]float64{-90, 90}, [2]float64{-180, 180}
+		hash     = make([]byte, 0, precision)
+		ch, bits int
+		even     = true // bits alternate between longitude and latitude, longitude first
+	)
+	for len(hash) < precision {
+		r, v := &lat, loc.Lat
+		if even {
+			r, v = &lon, loc.Lon
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch, r[0] = ch|1, mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		if bits++; bits == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			ch, bits = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// spatialIndex buckets ids by a grid of spatialCellDegrees cells, so that finding the ids near
+// a location only needs to look at the cells around it rather than at every location.
+type spatialIndex struct {
+	cells     map[spatialCell]map[string]location
+	locations map[string]location
+}
+
+type spatialCell struct{ lat, lon int }
+
+const spatialCellDegrees = 0.5
+
+func newSpatialIndex() spatialIndex {
+	return spatialIndex{cells: make(map[spatialCell]map[string]location), locations: make(map[string]location)}
+}
+
+func cellOf(loc location) spatialCell {
+	return spatialCell{int(math.Floor(loc.Lat / spatialCellDegrees)), int(math.Floor(loc.Lon / spatialCellDegrees))}
+}
+
+func (s spatialIndex) put(id string, loc location) {
+	s.remove(id)
+	cell := cellOf(loc)
+	if s.cells[cell] == nil {
+		s.cells[cell] = make(map[string]location)
+	}
+	s.cells[cell][id], s.locations[id] = loc, loc
+}
+
+func (s spatialIndex) remove(id string) {
+	loc, ok := s.locations[id]
+	if !ok {
+		return
+	}
+	cell := cellOf(loc)
+	delete(s.cells[cell], id)
+	if len(s.cells[cell]) == 0 {
+		delete(s.cells, cell)
+	}
+	delete(s.locations, id)
+}
+
+// within returns the distance to loc of every id at most radiusMeters away from it
+func (s spatialIndex) within(loc location, radiusMeters float64) map[string]float64 {
+	var (
+		res  = make(map[string]float64)
+		dLat = radiusMeters / 111195 // meters per degree of latitude
+		dLon = 360.0
+	)
+	if cos := math.Cos(loc.Lat * math.Pi / 180); cos > dLat/180 {
+		dLon = math.Min(360, dLat/cos)
+	}
+	var (
+		from = cellOf(location{Lat: loc.Lat - dLat, Lon: loc.Lon - dLon})
+		to   = cellOf(location{Lat: loc.Lat + dLat, Lon: loc.Lon + dLon})
+	)
+	for lat := from.lat; lat <= to.lat; lat++ {
+		for lon := from.lon; lon <= to.lon; lon++ {
+			for id, l := range s.cells[spatialCell{lat, lon}] {
+				if d := distanceMeters(loc, l); d <= radiusMeters {
+					res[id] = d
+				}
+			}
+		}
+	}
+	return res
+}
@@ -1,5 +1,7 @@
 module fl
 
+go 1.21
+
 require (
 	github.com/fortytw2/leaktest v1.2.0 // indirect
 	github.com/mailru/easyjson v0.0.0-20180730094502-03f2033d19d5 // indirect
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// readinessChecker is implemented by stores that can tell whether they're able to serve searches.
+// Stores that don't implement it are always ready.
+type readinessChecker interface {
+	readiness(ctx context.Context) []readinessCheck
+}
+
+// readinessCheck is one of the checks /readyz runs, e.g. whether the index exists
+type readinessCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// readinessTimeout bounds /readyz, so that a hanging cluster fails the probe rather than timing it out
+const readinessTimeout = 2 * time.Second
+
+// healthz is the liveness probe: the process is up and serving HTTP
+func (eh endpointHandler) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":"ok"}`)
+}
+
+// readyz is the readiness probe: 200 if every readinessCheck of the store is ok, 503 otherwise.
+// Either way, the body is the breakdown of the checks.
+func (eh endpointHandler) readyz(w http.ResponseWriter, r *http.Request) {
+	var res = struct {
+		Ready  bool             `json:"ready"`
+		Checks []readinessCheck `json:"checks"`
+	}{Ready: true, Checks: []readinessCheck{}}
+	if rc, ok := eh.store.(readinessChecker); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+		res.Checks = rc.readiness(ctx)
+	}
+	for _, c := range res.Checks {
+		res.Ready = res.Ready && c.OK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// readiness checks that the cluster isn't red, that db.index (or the alias) exists and has documents, and that
+// the circuit breaker isn't open. The doc count is only checked on an existing index.
+func (db db) readiness(ctx context.Context) (checks []readinessCheck) {
+	ctx, span := startSpan(ctx, "db.readiness", spanKindInternal)
+	defer func() {
+		for _, c := range checks {
+			span.setAttr(c.Name, c.OK)
+		}
+		span.end(nil)
+	}()
+	var (
+		health  = readinessCheck{Name: "cluster_health"}
+		index   = readinessCheck{Name: "index_exists"}
+		count   = readinessCheck{Name: "doc_count"}
+		breaker = readinessCheck{Name: "circuit_breaker", OK: true, Detail: "closed"}
+	)
+	if db.breaker != nil { // checked first, since the checks below go through it
+		state := db.breaker.current()
+		breaker.OK, breaker.Detail = state != breakerOpen, state.String()
+	}
+	res, err := db.client.ClusterHealth().Do(ctx)
+	switch {
+	case err != nil:
+		health.Detail = err.Error()
+	case res.Status == "red":
+		health.Detail = "cluster " + res.ClusterName + " is red"
+	default:
+		health.OK, health.Detail = true, "cluster "+res.ClusterName+" is "+res.Status
+	}
+
+	exists, err := db.client.IndexExists(db.index).Do(ctx)
+	switch {
+	case err != nil:
+		index.Detail = err.Error()
+	case !exists:
+		index.Detail = "index " + db.index + " doesn't exist"
+	default:
+		index.OK, index.Detail = true, "index "+db.index+" exists"
+	}
+
+	if !index.OK {
+		count.Detail = "index " + db.index + " doesn't exist"
+		return []readinessCheck{health, index, count, breaker}
+	}
+	n, err := db.client.Count(db.index).Do(ctx)
+	switch {
+	case err != nil:
+		count.Detail = err.Error()
+	case n == 0:
+		count.Detail = "index " + db.index + " is empty"
+	default:
+		count.OK, count.Detail = true, fmt.Sprintf("%v documents", n)
+	}
+	return []readinessCheck{health, index, count, breaker}
+}
+
+// readiness checks that the memoryStore has documents, i.e. that the dump wasn't empty
+func (s *memoryStore) readiness(ctx context.Context) []readinessCheck {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.docs) == 0 {
+		return []readinessCheck{{Name: "doc_count", Detail: "no documents"}}
+	}
+	return []readinessCheck{{Name: "doc_count", OK: true, Detail: fmt.Sprintf("%v documents", len(s.docs))}}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Readiness test checks /readyz against a fakeES in every state that should take a replica out of the load balancer.
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name               string
+		health             string
+		items              string
+		createIndex        bool
+		breakerOpen        bool
+		expectedOK         []bool // of cluster_health, index_exists, doc_count and circuit_breaker
+		expectedStatusCode int
+	}{
+		{name: "ready", health: "green", items: `"camera",51,0,london/camera,[]`, createIndex: true, expectedOK: []bool{true, true, true, true}, expectedStatusCode: http.StatusOK},
+		{name: "yellow cluster is ready", health: "yellow", items: `"camera",51,0,london/camera,[]`, createIndex: true, expectedOK: []bool{true, true, true, true}, expectedStatusCode: http.StatusOK},
+		{name: "red cluster", health: "red", items: `"camera",51,0,london/camera,[]`, createIndex: true, expectedOK: []bool{false, true, true, true}, expectedStatusCode: http.StatusServiceUnavailable},
+		{name: "empty index", health: "green", createIndex: true, expectedOK: []bool{true, true, false, true}, expectedStatusCode: http.StatusServiceUnavailable},
+		{name: "missing index", health: "green", expectedOK: []bool{true, false, false, true}, expectedStatusCode: http.StatusServiceUnavailable},
+		{name: "open circuit breaker", health: "green", items: `"camera",51,0,london/camera,[]`, createIndex: true, breakerOpen: true, expectedOK: []bool{false, false, false, false}, expectedStatusCode: http.StatusServiceUnavailable},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				es = newFakeES(fakeES6, t)
+				db = es.newDB("items", t)
+				w  = httptest.NewRecorder()
+			)
+			es.health = tc.health
+			if tc.createIndex && tc.items == "" {
+				if err := db.createIndex(context.Background()); err != nil {
+					t.Errorf("couldn't create index: %v", err)
+					t.FailNow()
+				}
+			} else if tc.createIndex {
+				loadItemsIntoTestIndex(tc.items, false, db, t)
+			}
+			for i := 0; tc.breakerOpen && i < db.breaker.threshold; i++ {
+				db.breaker.record(true)
+			}
+			newEndpointHandler(db).ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+			if tc.expectedStatusCode != w.Code {
+				t.Errorf("expected status code %v but got %v", tc.expectedStatusCode, w.Code)
+			}
+			var res struct {
+				Ready  bool             `json:"ready"`
+				Checks []readinessCheck `json:"checks"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Errorf("couldn't read response payload: %v", err)
+				t.FailNow()
+			}
+			var actualOK []bool
+			for _, c := range res.Checks {
+				actualOK = append(actualOK, c.OK)
+			}
+			if !reflect.DeepEqual(tc.expectedOK, actualOK) || res.Ready != (tc.expectedStatusCode == http.StatusOK) {
+				t.Errorf("expected checks %v but got %+v", tc.expectedOK, res)
+			}
+		})
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	tests := []struct {
+		name               string
+		target             string
+		store              itemStore
+		expectedStatusCode int
+	}{
+		{name: "healthz doesn't depend on the store", target: "/healthz", store: newMemoryStore(nil), expectedStatusCode: http.StatusOK},
+		{name: "empty memory store isn't ready", target: "/readyz", store: newMemoryStore(nil), expectedStatusCode: http.StatusServiceUnavailable},
+		{name: "memory store with items is ready", target: "/readyz", store: newMemoryStore([]item{{Name: "camera"}}), expectedStatusCode: http.StatusOK},
+		{name: "stores without checks are ready", target: "/readyz", store: &fakeStore{}, expectedStatusCode: http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			newEndpointHandler(tc.store).ServeHTTP(w, httptest.NewRequest("GET", tc.target, nil))
+			if tc.expectedStatusCode != w.Code {
+				t.Errorf("expected status code %v but got %v: %v", tc.expectedStatusCode, w.Code, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// itemResource is an item as /items reads and writes it: along with its stable id (see itemID)
+type itemResource struct {
+	ID string `json:"id"`
+	item
+}
+
+// itemsEntry is an item of GET /items, which is marked as not found if there's no item with its id
+type itemsEntry struct {
+	ID    string `json:"id"`
+	Found bool   `json:"found"`
+	*item
+}
+
+// itemsResponse is GET /items: an entry for every requested id, in the requested order
+type itemsResponse struct {
+	Items []itemsEntry `json:"items"`
+	Count int          `json:"count"` // of found items
+}
+
+// maxItemsPerGet caps the ids of GET /items, e.g. a long favourites list takes a few requests
+var maxItemsPerGet = 100
+
+// maxItemBodyBytes caps the body of a write to /items; an item is a few hundred bytes
+const maxItemBodyBytes = 1 << 20
+
+// itemIDRegexp is what stable ids look like: listing numbers, url hashes, and their -2, -3... suffixes (see itemIDs)
+var itemIDRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ruleFields are the item fields checked by each validation rule, for the field of the errors of rejected items
+var ruleFields = map[string]string{"coordinates": "location", "service_area": "location", "name": "name", "url_slug": "url", "image_extensions": "img_urls"}
+
+// withItemTimeout bounds a handle of /items by eh.itemTimeout, past which its store calls fail with 504
+func withItemTimeout(handle func(endpointHandler, http.ResponseWriter, *http.Request)) func(endpointHandler, http.ResponseWriter, *http.Request) {
+	return func(eh endpointHandler, w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), eh.itemTimeout)
+		defer cancel()
+		handle(eh, w, r.WithContext(ctx))
+	}
+}
+
+// getItem is GET /items/{id}: the item with that id, or 404
+func (eh endpointHandler) getItem(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	if !checkItemID(w, r, id) {
+		return
+	}
+	it, err := eh.store.get(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, id, err)
+		return
+	}
+	writeItem(w, http.StatusOK, id, it)
+}
+
+// getItems is GET /items?ids=a,b,c: the items with those ids, in that order, for carts and favourites lists.
+// Ids without an item are marked as not found rather than left out, so that entries line up with the ids.
+func (eh endpointHandler) getItems(w http.ResponseWriter, r *http.Request) {
+	ids, problems := parseItemIDs(r.URL.Query())
+	if len(problems) > 0 {
+		writeError(w, r, http.StatusBadRequest, problems...)
+		return
+	}
+	var (
+		unique = make([]string, 0, len(ids))
+		seen   = make(map[string]bool, len(ids))
+	)
+	for _, id := range ids {
+		if !seen[id] {
+			unique, seen[id] = append(unique, id), true
+		}
+	}
+	items, err := eh.store.getMany(r.Context(), unique)
+	if err != nil {
+		writeStoreError(w, r, "", err)
+		return
+	}
+	body := itemsResponse{Items: make([]itemsEntry, len(ids))}
+	for i, id := range ids {
+		body.Items[i] = itemsEntry{ID: id}
+		if it, ok := items[id]; ok {
+			body.Items[i].Found, body.Items[i].item = true, &it
+			body.Count++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// parseItemIDs returns the comma separated ids of the ids param, or every problem with them
+func parseItemIDs(q url.Values) ([]string, []apiError) {
+	raw := strings.TrimSpace(q.Get("ids"))
+	if raw == "" {
+		return nil, []apiError{{Code: "missing_parameter", Message: "ids is required", Field: "ids"}}
+	}
+	ids := strings.Split(raw, ",")
+	if len(ids) > maxItemsPerGet {
+		return nil, []apiError{{Code: "too_many_ids", Message: fmt.Sprintf("ids can't have more than %v ids", maxItemsPerGet), Field: "ids"}}
+	}
+	var problems []apiError
+	for i, id := range ids {
+		ids[i] = strings.TrimSpace(id)
+		if !itemIDRegexp.MatchString(ids[i]) {
+			problems = append(problems, apiError{Code: "invalid_parameter", Message: fmt.Sprintf("ids has %q, but ids must be 1 to 64 letters, digits, - or _", ids[i]), Field: "ids"})
+		}
+	}
+	return ids, problems
+}
+
+// createItem is POST /items: it creates the item of the body under the body's id, or the item's stable id if it has
+// none, and answers 201 with its Location, or 409 if there's an item with that id already
+func (eh endpointHandler) createItem(w http.ResponseWriter, r *http.Request) {
+	var body itemResource
+	if !decodeItemBody(w, r, &body) {
+		return
+	}
+	if body.ID == "" {
+		body.ID = itemID(body.item)
+	}
+	if !checkItemID(w, r, body.ID) {
+		return
+	}
+	it, ok := eh.validateItemBody(w, r, body.item)
+	if !ok {
+		return
+	}
+	if err := eh.store.create(r.Context(), body.ID, it); err != nil {
+		writeStoreError(w, r, body.ID, err)
+		return
+	}
+	itemWrites.inc("create")
+	w.Header().Set("Location", "/items/"+url.PathEscape(body.ID))
+	writeItem(w, http.StatusCreated, body.ID, it)
+}
+
+// replaceItem is PUT /items/{id}: it creates or replaces the item with that id with the item of the body, and
+// answers 201 or 200 respectively
+func (eh endpointHandler) replaceItem(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	if !checkItemID(w, r, id) {
+		return
+	}
+	var body itemResource
+	if !decodeItemBody(w, r, &body) {
+		return
+	}
+	if body.ID != "" && body.ID != id {
+		writeError(w, r, http.StatusBadRequest, apiError{Code: "invalid_body", Message: "the id of the body must be the id of the path, or left out", Field: "id"})
+		return
+	}
+	it, ok := eh.validateItemBody(w, r, body.item)
+	if !ok {
+		return
+	}
+	created, err := eh.store.put(r.Context(), id, it)
+	if err != nil {
+		writeStoreError(w, r, id, err)
+		return
+	}
+	itemWrites.inc("replace")
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		w.Header().Set("Location", "/items/"+url.PathEscape(id))
+	}
+	writeItem(w, status, id, it)
+}
+
+// patchRetries is how many times patchItem re-reads and re-patches an item that was written while it patched it
+const patchRetries = 3
+
+// patchItem is PATCH /items/{id}: it applies the body as a JSON merge patch (RFC 7396) to the item with that id, i.e.
+// the fields of the body replace the item's, nested objects are merged and null removes a field. The patched item
+// only replaces the one it was patched from (see itemStore.update), so that concurrent writes aren't lost: the patch
+// is applied again to what they wrote, up to patchRetries times, and answers 409 past that.
+func (eh endpointHandler) patchItem(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	if !checkItemID(w, r, id) {
+		return
+	}
+	var patch map[string]interface{}
+	if !decodeItemBody(w, r, &patch) {
+		return
+	}
+	if patchID, ok := patch["id"]; ok && patchID != id {
+		writeError(w, r, http.StatusBadRequest, apiError{Code: "invalid_body", Message: "the id of an item can't be patched", Field: "id"})
+		return
+	}
+	for attempt := 0; ; attempt++ {
+		current, version, err := eh.store.getVersion(r.Context(), id)
+		if err != nil {
+			writeStoreError(w, r, id, err)
+			return
+		}
+		it, ok := eh.patchedItem(w, r, id, current, patch)
+		if !ok {
+			return
+		}
+		err = eh.store.update(r.Context(), id, it, version)
+		if errors.Is(err, errItemChanged) && attempt < patchRetries {
+			continue
+		}
+		if err != nil {
+			writeStoreError(w, r, id, err)
+			return
+		}
+		itemWrites.inc("patch")
+		writeItem(w, http.StatusOK, id, it)
+		return
+	}
+}
+
+// patchedItem is current with the merge patch applied, validated like a body; it answers 400 and returns false if
+// the patched item isn't valid
+func (eh endpointHandler) patchedItem(w http.ResponseWriter, r *http.Request, id string, current item, patch map[string]interface{}) (item, bool) {
+	var target interface{}
+	bs, _ := json.Marshal(itemResource{id, current}) // marshalling an item can't fail
+	_ = json.Unmarshal(bs, &target)
+	bs, _ = json.Marshal(mergePatch(target, patch))
+	var body itemResource
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		writeError(w, r, http.StatusBadRequest, apiError{Code: "invalid_body", Message: "the patched item isn't valid: " + err.Error()})
+		return item{}, false
+	}
+	if body.ImgURLs == nil {
+		body.ImgURLs = []string{}
+	}
+	return eh.validateItemBody(w, r, body.item)
+}
+
+// deleteItem is DELETE /items/{id}: it answers 204, or 404 if there's no item with that id
+func (eh endpointHandler) deleteItem(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	if !checkItemID(w, r, id) {
+		return
+	}
+	if err := eh.store.delete(r.Context(), id); err != nil {
+		writeStoreError(w, r, id, err)
+		return
+	}
+	itemWrites.inc("delete")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mergePatch applies a JSON merge patch to target, both as decoded by encoding/json, and returns the result
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// decodeItemBody decodes the JSON body of r into v, rejecting unknown fields, and answers 400 (or 413 past
+// maxItemBodyBytes) if it can't, in which case ok is false. Items without images get an empty list, like on ingest.
+func decodeItemBody(w http.ResponseWriter, r *http.Request, v interface{}) (ok bool) {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxItemBodyBytes))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, r, http.StatusRequestEntityTooLarge, apiError{Code: "too_large", Message: "the body can't be longer than 1MB"})
+		return false
+	case err != nil:
+		writeError(w, r, http.StatusBadRequest, apiError{Code: "invalid_body", Message: "the body must be a JSON item: " + err.Error()})
+		return false
+	}
+	if res, ok := v.(*itemResource); ok && res.ImgURLs == nil {
+		res.ImgURLs = []string{}
+	}
+	return true
+}
+
+// checkItemID answers 400 if id doesn't look like a stable id, in which case ok is false
+func checkItemID(w http.ResponseWriter, r *http.Request, id string) (ok bool) {
+	if !itemIDRegexp.MatchString(id) {
+		writeError(w, r, http.StatusBadRequest, apiError{Code: "invalid_parameter", Message: "id must be 1 to 64 letters, digits, - or _", Field: "id"})
+		return false
+	}
+	return true
+}
+
+// validateItemBody runs the validation rules of ingest on it, and returns the item to store (possibly fixed), or
+// answers 422 with the rule it broke, in which case ok is false
+func (eh endpointHandler) validateItemBody(w http.ResponseWriter, r *http.Request, it item) (_ item, ok bool) {
+	it, ok, issues := eh.validator.validateItem(it)
+	for _, issue := range issues {
+		slog.WarnContext(r.Context(), "validateItemBody: "+issue.String(), "rule", issue.Rule, "url", issue.Item.URL, "action", string(issue.Action), "fixed", issue.Fixed)
+	}
+	if !ok {
+		issue := issues[len(issues)-1] // the one that rejected it
+		writeError(w, r, http.StatusUnprocessableEntity, apiError{Code: "invalid_item", Message: issue.Problem, Field: ruleFields[issue.Rule]})
+	}
+	return it, ok
+}
+
+// writeStoreError answers an error of the item store: 404 for a missing item, 409 for an existing one, 504 past the
+// deadline of the request, 500 otherwise
+func writeStoreError(w http.ResponseWriter, r *http.Request, id string, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, r, http.StatusGatewayTimeout, apiError{Code: "timeout", Message: "the item store took too long"})
+	case errors.Is(err, errItemNotFound):
+		writeError(w, r, http.StatusNotFound, apiError{Code: "not_found", Message: "item " + id + " doesn't exist", Field: "id"})
+	case errors.Is(err, errItemExists):
+		writeError(w, r, http.StatusConflict, apiError{Code: "conflict", Message: "item " + id + " exists already; PUT replaces it", Field: "id"})
+	case errors.Is(err, errItemChanged):
+		writeError(w, r, http.StatusConflict, apiError{Code: "conflict", Message: "item " + id + " kept changing while it was patched; retry", Field: "id"})
+	case errors.Is(err, errStoreUnavailable):
+		writeError(w, r, http.StatusInternalServerError, apiError{Code: "store_unavailable", Message: "the item store is unavailable"})
+	default:
+		writeError(w, r, http.StatusInternalServerError, apiError{Code: "internal_error", Message: "the request failed"})
+	}
+}
+
+// writeItem answers status with the item with that id
+func writeItem(w http.ResponseWriter, status int, id string, it item) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(itemResource{id, it})
+}
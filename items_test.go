@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Items test writes items through /items, on a memoryStore holding a camera with id 1, and expects the stored
+// items, as searches see them, along with the responses.
+func TestItems(t *testing.T) {
+	var (
+		camera = item{"camera", location{51.5, -0.1}, "london/camera-1", []string{"camera.jpg"}}
+		tripod = item{"tripod", location{51.5, -0.1}, "london/tripod-42", []string{}}
+	)
+	tests := []struct {
+		name               string
+		method, target     string
+		body               string
+		expectedStatusCode int
+		expectedLocation   string
+		expectedErrors     []apiError
+		expectedItems      map[string]item // every stored item, by id
+	}{
+		{
+			name:   "create",
+			method: "POST", target: "/items",
+			body:               `{"name":"tripod","location":{"lat":51.5,"lon":-0.1},"url":"london/tripod-42"}`,
+			expectedStatusCode: http.StatusCreated,
+			expectedLocation:   "/items/42",
+			expectedItems:      map[string]item{"1": camera, "42": tripod},
+		},
+		{
+			name:   "create with an id",
+			method: "POST", target: "/items",
+			body:               `{"id":"tripod_a","name":"tripod","location":{"lat":51.5,"lon":-0.1},"url":"london/tripod-42","img_urls":[]}`,
+			expectedStatusCode: http.StatusCreated,
+			expectedLocation:   "/items/tripod_a",
+			expectedItems:      map[string]item{"1": camera, "tripod_a": tripod},
+		},
+		{
+			name:   "create an existing item",
+			method: "POST", target: "/items",
+			body:               `{"name":"camera","location":{"lat":51.5,"lon":-0.1},"url":"london/camera-1"}`,
+			expectedStatusCode: http.StatusConflict,
+			expectedErrors:     []apiError{{Code: "conflict", Message: "item 1 exists already; PUT replaces it", Field: "id"}},
+		},
+		{
+			name:   "fixed like on ingest",
+			method: "POST", target: "/items",
+			body:               `{"name":"tripod","location":{"lat":-0.1,"lon":51.5},"url":"london/tripod-42","img_urls":["tripod.exe"]}`,
+			expectedStatusCode: http.StatusCreated,
+			expectedLocation:   "/items/42",
+			expectedItems:      map[string]item{"1": camera, "42": tripod},
+		},
+		{
+			name:   "rejected like on ingest",
+			method: "POST", target: "/items",
+			body:               `{"name":" ","location":{"lat":51.5,"lon":-0.1},"url":"london/tripod-42"}`,
+			expectedStatusCode: http.StatusUnprocessableEntity,
+			expectedErrors:     []apiError{{Code: "invalid_item", Message: "empty name", Field: "name"}},
+		},
+		{
+			name:   "unknown field",
+			method: "POST", target: "/items",
+			body:               `{"title":"tripod","location":{"lat":51.5,"lon":-0.1},"url":"london/tripod-42"}`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:   "not JSON",
+			method: "POST", target: "/items",
+			body:               `name=tripod`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:   "replace",
+			method: "PUT", target: "/items/1",
+			body:               `{"name":"tripod","location":{"lat":51.5,"lon":-0.1},"url":"london/tripod-42"}`,
+			expectedStatusCode: http.StatusOK,
+			expectedItems:      map[string]item{"1": tripod},
+		},
+		{
+			name:   "replace a missing item creates it",
+			method: "PUT", target: "/items/42",
+			body:               `{"id":"42","name":"tripod","location":{"lat":51.5,"lon":-0.1},"url":"london/tripod-42"}`,
+			expectedStatusCode: http.StatusCreated,
+			expectedLocation:   "/items/42",
+			expectedItems:      map[string]item{"1": camera, "42": tripod},
+		},
+		{
+			name:   "replace with another id",
+			method: "PUT", target: "/items/1",
+			body:               `{"id":"2","name":"tripod","location":{"lat":51.5,"lon":-0.1},"url":"london/tripod-42"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedErrors:     []apiError{{Code: "invalid_body", Message: "the id of the body must be the id of the path, or left out", Field: "id"}},
+		},
+		{
+			name:   "invalid id",
+			method: "PUT", target: "/items/london%2Fcamera",
+			body:               `{"name":"tripod","location":{"lat":51.5,"lon":-0.1},"url":"london/tripod-42"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedErrors:     []apiError{{Code: "invalid_parameter", Message: "id must be 1 to 64 letters, digits, - or _", Field: "id"}},
+		},
+		{
+			name:   "patch",
+			method: "PATCH", target: "/items/1",
+			body:               `{"name":"camera bag","location":{"lat":51.6},"img_urls":null}`,
+			expectedStatusCode: http.StatusOK,
+			expectedItems:      map[string]item{"1": {"camera bag", location{51.6, -0.1}, "london/camera-1", []string{}}},
+		},
+		{
+			name:   "patch rejected like on ingest",
+			method: "PATCH", target: "/items/1",
+			body:               `{"name":null}`,
+			expectedStatusCode: http.StatusUnprocessableEntity,
+			expectedErrors:     []apiError{{Code: "invalid_item", Message: "empty name", Field: "name"}},
+		},
+		{
+			name:   "patch the id",
+			method: "PATCH", target: "/items/1",
+			body:               `{"id":"2"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedErrors:     []apiError{{Code: "invalid_body", Message: "the id of an item can't be patched", Field: "id"}},
+		},
+		{
+			name:   "patch a missing item",
+			method: "PATCH", target: "/items/42",
+			body:               `{"name":"tripod"}`,
+			expectedStatusCode: http.StatusNotFound,
+			expectedErrors:     []apiError{{Code: "not_found", Message: "item 42 doesn't exist", Field: "id"}},
+		},
+		{
+			name:   "delete",
+			method: "DELETE", target: "/items/1",
+			expectedStatusCode: http.StatusNoContent,
+			expectedItems:      map[string]item{},
+		},
+		{
+			name:   "delete a missing item",
+			method: "DELETE", target: "/items/42",
+			expectedStatusCode: http.StatusNotFound,
+			expectedErrors:     []apiError{{Code: "not_found", Message: "item 42 doesn't exist", Field: "id"}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				store = newMemoryStore(nil)
+				w     = httptest.NewRecorder()
+			)
+			_, _ = store.put(context.Background(), "1", camera)
+			r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			newEndpointHandler(store).ServeHTTP(w, r.WithContext(withAPIKey(r.Context(), apiKey{name: "ingest", write: true})))
+			if tc.expectedStatusCode != w.Code {
+				t.Errorf("expected status code %v but got %v: %v", tc.expectedStatusCode, w.Code, w.Body)
+				t.FailNow()
+			}
+			if actual := w.Header().Get("Location"); tc.expectedLocation != actual {
+				t.Errorf("expected Location %q but got %q", tc.expectedLocation, actual)
+			}
+			if w.Code >= 400 {
+				var body errorBody
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Code == "" {
+					t.Errorf("expected an error body but got %v", err)
+				}
+				if tc.expectedErrors != nil && !reflect.DeepEqual(tc.expectedErrors, body.Errors) {
+					t.Errorf("expected errors %+v but got %+v", tc.expectedErrors, body.Errors)
+				}
+				return
+			}
+			if w.Code != http.StatusNoContent {
+				var body itemResource
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil || !reflect.DeepEqual(tc.expectedItems[body.ID], body.item) {
+					t.Errorf("expected the stored item %+v but got %+v %v", tc.expectedItems[body.ID], body, err)
+				}
+			}
+			actual := make(map[string]item)
+			for _, name := range []string{"camera", "tripod"} {
+				res, _ := store.search(context.Background(), name, location{51.5, -0.1})
+				for i, it := range res.items {
+					actual[res.ids[i]] = it
+				}
+			}
+			if !reflect.DeepEqual(tc.expectedItems, actual) {
+				t.Errorf("expected the searchable items to be %+v but got %+v", tc.expectedItems, actual)
+			}
+		})
+	}
+}
+
+// Merge patch test applies the examples of RFC 7396.
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target, patch, expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tc := range tests {
+		var target, patch interface{}
+		_ = json.Unmarshal([]byte(tc.target), &target)
+		_ = json.Unmarshal([]byte(tc.patch), &patch)
+		actual, _ := json.Marshal(mergePatch(target, patch))
+		assertJSONEqual(tc.expected, string(actual), t)
+	}
+}
+
+// Item reads test gets items by id from a memoryStore holding a camera with id 1 and a tripod with id 42, and
+// expects them in the requested order, with missing ids marked.
+func TestGetItems(t *testing.T) {
+	var (
+		camera = item{"camera", location{51.5, -0.1}, "london/camera-1", []string{"camera.jpg"}}
+		tripod = item{"tripod", location{51.5, -0.1}, "london/tripod-42", []string{}}
+		store  = newMemoryStore(nil)
+	)
+	_, _ = store.put(context.Background(), "1", camera)
+	_, _ = store.put(context.Background(), "42", tripod)
+	tests := []struct {
+		name               string
+		target             string
+		expectedStatusCode int
+		expected           string
+		expectedErrors     []apiError
+	}{
+		{
+			name:               "one item",
+			target:             "/items/42",
+			expectedStatusCode: http.StatusOK,
+			expected:           `{"id":"42","name":"tripod","location":{"lat":51.5,"lon":-0.1},"url":"london/tripod-42","img_urls":[]}`,
+		},
+		{
+			name:               "missing item",
+			target:             "/items/7",
+			expectedStatusCode: http.StatusNotFound,
+			expectedErrors:     []apiError{{Code: "not_found", Message: "item 7 doesn't exist", Field: "id"}},
+		},
+		{
+			name:               "items in the requested order, missing ones marked",
+			target:             "/items?ids=42,7,1,42",
+			expectedStatusCode: http.StatusOK,
+			expected: `{"items":[
+				{"id":"42","found":true,"name":"tripod","location":{"lat":51.5,"lon":-0.1},"url":"london/tripod-42","img_urls":[]},
+				{"id":"7","found":false},
+				{"id":"1","found":true,"name":"camera","location":{"lat":51.5,"lon":-0.1},"url":"london/camera-1","img_urls":["camera.jpg"]},
+				{"id":"42","found":true,"name":"tripod","location":{"lat":51.5,"lon":-0.1},"url":"london/tripod-42","img_urls":[]}],
+				"count":3}`,
+		},
+		{
+			name:               "no ids",
+			target:             "/items",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedErrors:     []apiError{{Code: "missing_parameter", Message: "ids is required", Field: "ids"}},
+		},
+		{
+			name:               "every invalid id is reported at once",
+			target:             "/items?ids=1,,london%2Fcamera",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedErrors: []apiError{
+				{Code: "invalid_parameter", Message: `ids has "", but ids must be 1 to 64 letters, digits, - or _`, Field: "ids"},
+				{Code: "invalid_parameter", Message: `ids has "london/camera", but ids must be 1 to 64 letters, digits, - or _`, Field: "ids"},
+			},
+		},
+		{
+			name:               "too many ids",
+			target:             "/items?ids=1" + strings.Repeat(",1", maxItemsPerGet),
+			expectedStatusCode: http.StatusBadRequest,
+			expectedErrors:     []apiError{{Code: "too_many_ids", Message: "ids can't have more than 100 ids", Field: "ids"}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			newEndpointHandler(store).ServeHTTP(w, httptest.NewRequest("GET", tc.target, nil))
+			if tc.expectedStatusCode != w.Code {
+				t.Errorf("expected status code %v but got %v: %v", tc.expectedStatusCode, w.Code, w.Body)
+				t.FailNow()
+			}
+			if w.Code == http.StatusOK {
+				assertJSONEqual(tc.expected, w.Body.String(), t)
+				return
+			}
+			var body errorBody
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil || !reflect.DeepEqual(tc.expectedErrors, body.Errors) {
+				t.Errorf("expected errors %+v but got %+v %v", tc.expectedErrors, body.Errors, err)
+			}
+		})
+	}
+}
+
+// Patch conflict test patches an item on a fakeES that writes or deletes it between the read and the write of the
+// patch, and expects the patch to be applied to what was written, rather than to undo it, and to give up with 409 on
+// an item that keeps changing.
+func TestPatchConcurrentWrites(t *testing.T) {
+	const written = `{"name":"camera","location":{"lat":51,"lon":0},"url":"london/camera-2","img_urls":[]}`
+	tests := []struct {
+		name               string
+		afterGet           func(es *fakeES, index *fakeESIndex, id string)
+		expectedStatusCode int
+		expectedItem       *item // stored, if any
+		expectedUpdates    int
+	}{
+		{
+			name:               "no concurrent write",
+			expectedStatusCode: http.StatusOK,
+			expectedItem:       &item{"lens", location{51, 0}, "london/camera-1", []string{}},
+			expectedUpdates:    1,
+		},
+		{
+			name: "written in between",
+			afterGet: func(es *fakeES, index *fakeESIndex, id string) {
+				index.put(id, []byte(written))
+				es.afterGet = nil
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedItem:       &item{"lens", location{51, 0}, "london/camera-2", []string{}},
+			expectedUpdates:    2,
+		},
+		{
+			name:               "deleted in between",
+			afterGet:           func(_ *fakeES, index *fakeESIndex, id string) { index.delete(id) },
+			expectedStatusCode: http.StatusNotFound,
+			expectedUpdates:    1,
+		},
+		{
+			name:               "written on every read",
+			afterGet:           func(_ *fakeES, index *fakeESIndex, id string) { index.put(id, []byte(written)) },
+			expectedStatusCode: http.StatusConflict,
+			expectedItem:       &item{"camera", location{51, 0}, "london/camera-2", []string{}},
+			expectedUpdates:    patchRetries + 1,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				es = newFakeES(fakeES8, t)
+				db = es.newDB("items", t)
+				w  = httptest.NewRecorder()
+				r  = httptest.NewRequest("PATCH", "/items/1", strings.NewReader(`{"name":"lens"}`))
+			)
+			loadItemsIntoTestIndex(`"tripod",51,0,london/tripod-2,[]`, false, db, t)
+			if _, err := db.put(context.Background(), "1", item{"camera", location{51, 0}, "london/camera-1", []string{}}); err != nil {
+				t.Errorf("couldn't put item: %v", err)
+				t.FailNow()
+			}
+			if tc.afterGet != nil {
+				es.afterGet = func(index *fakeESIndex, id string) { tc.afterGet(es, index, id) }
+			}
+			newEndpointHandler(db).ServeHTTP(w, r.WithContext(withAPIKey(r.Context(), apiKey{name: "ingest", write: true})))
+			if tc.expectedStatusCode != w.Code {
+				t.Errorf("expected status code %v but got %v: %v", tc.expectedStatusCode, w.Code, w.Body)
+			}
+			if updates := es.received("PUT", "/items/_doc/1"); len(updates)-1 != tc.expectedUpdates || !strings.Contains(updates[len(updates)-1].Query, "if_seq_no=") {
+				t.Errorf("expected %v updates with if_seq_no but got %v", tc.expectedUpdates, updates[1:])
+			}
+			es.afterGet = nil
+			it, err := db.get(context.Background(), "1")
+			if tc.expectedItem == nil && !errors.Is(err, errItemNotFound) {
+				t.Errorf("expected the item to stay deleted but got %v, %v", it, err)
+			}
+			if tc.expectedItem != nil && (err != nil || !reflect.DeepEqual(*tc.expectedItem, it)) {
+				t.Errorf("expected the item %v but got %v, %v", *tc.expectedItem, it, err)
+			}
+		})
+	}
+}
+
+// stalledStore is an itemStore whose reads and writes of items wait for their deadline, like a stalled cluster
+type stalledStore struct {
+	itemStore
+}
+
+func (s stalledStore) get(ctx context.Context, id string) (item, error) {
+	<-ctx.Done()
+	return item{}, fmt.Errorf("get: %w", ctx.Err())
+}
+
+func (s stalledStore) delete(ctx context.Context, id string) error {
+	<-ctx.Done()
+	return fmt.Errorf("delete: %w", ctx.Err())
+}
+
+// Item timeout test expects reads and writes of /items on a stalled store to give up with 504 once past the item
+// timeout.
+func TestItemTimeout(t *testing.T) {
+	handler := newEndpointHandler(stalledStore{newMemoryStore(nil)})
+	handler.itemTimeout = 10 * time.Millisecond
+	for _, method := range []string{"GET", "DELETE"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/items/1", nil)
+		start := time.Now()
+		handler.ServeHTTP(w, r.WithContext(withAPIKey(r.Context(), apiKey{name: "ingest", write: true})))
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("expected %v /items/1 to time out with %v but got %v: %v", method, http.StatusGatewayTimeout, w.Code, w.Body)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("expected %v /items/1 to give up after 10ms but it took %v", method, elapsed)
+		}
+	}
+}
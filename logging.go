@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Logs are JSON lines on stderr, through log/slog. Lines logged with a request's context carry its request_id,
+// which is also sent to ES as X-Opaque-Id, so that ES slow logs and tasks can be traced back to a request.
+
+type requestIDKey struct{}
+
+// requestIDRegexp is what's accepted as an incoming X-Request-ID; anything else is replaced, so that clients
+// can't inject into logs
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// setupLogging makes every log line (including the log package's) a JSON line on w, at level or above
+func setupLogging(w io.Writer, level slog.Level) {
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})}))
+}
+
+// parseLogLevel parses debug, info, warn or error
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("parseLogLevel: %q isn't one of debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// fatal logs msg at error level, and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestIDHandler adds the request_id of the context to every record
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request id of ctx, or "" outside of a request
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// logRequests accepts the X-Request-ID of a request or generates one, echoes it in the response, carries it
+// in the request's context, and logs the request once served
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			start = time.Now()
+			id    = r.Header.Get("X-Request-ID")
+			rec   = &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		)
+		if !requestIDRegexp.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(withRequestID(r.Context(), id))
+		next.ServeHTTP(rec, r)
+
+		level := slog.LevelInfo
+		if rec.code >= 500 {
+			level = slog.LevelError
+		}
+		slog.Log(r.Context(), level, "request", "method", r.Method, "path", r.URL.Path, "status", rec.code,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000, "remote_addr", r.RemoteAddr)
+	})
+}
+
+// opaqueIDTransport sends the request id of a request's context to ES as X-Opaque-Id
+type opaqueIDTransport struct {
+	next http.RoundTripper
+}
+
+func (t opaqueIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := requestIDFrom(req.Context()); id != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Opaque-Id", id)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Request id test searches with and without an X-Request-ID, and expects the id in the response, in every log line
+// of the request and as the X-Opaque-Id of the ES search it caused.
+func TestRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	setupLogging(&logs, slog.LevelDebug)
+	defer setupLogging(os.Stderr, slog.LevelInfo)
+
+	tests := []struct {
+		name       string
+		requestID  string
+		expectedID func(id string) bool
+	}{
+		{name: "accepted", requestID: "abc-123", expectedID: func(id string) bool { return id == "abc-123" }},
+		{name: "generated", requestID: "", expectedID: func(id string) bool { return len(id) == 16 }},
+		{name: "replaced when it could inject into logs", requestID: "abc\",\"level\":\"ERROR", expectedID: func(id string) bool { return len(id) == 16 }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				es  = newFakeES(fakeES6, t)
+				db  = es.newDB("items", t)
+				w   = httptest.NewRecorder()
+				req = httptest.NewRequest("GET", "/search?searchTerm=camera&lat=51&lng=0", nil)
+			)
+			loadItemsIntoTestIndex(`"camera",51,0,london/camera,[]`, false, db, t)
+			db.deleteIndex() // so that the search fails, and logs an error
+			logs.Reset()
+			if tc.requestID != "" {
+				req.Header.Set("X-Request-ID", tc.requestID)
+			}
+			logRequests(newEndpointHandler(db)).ServeHTTP(w, req)
+
+			id := w.Header().Get("X-Request-ID")
+			if !tc.expectedID(id) {
+				t.Errorf("unexpected request id %q", id)
+			}
+			searches := es.received("POST", "/items/_search")
+			if len(searches) != 1 || searches[0].Header.Get("X-Opaque-Id") != id {
+				t.Errorf("expected the ES search to have X-Opaque-Id %v but got %v", id, searches)
+			}
+			lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+			if len(lines) != 2 { // the search error, and the request
+				t.Errorf("expected 2 log lines but got %v", lines)
+			}
+			for _, line := range lines {
+				var record map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Errorf("expected a JSON log line but got %v", line)
+					continue
+				}
+				if record["request_id"] != id || record["level"] != "ERROR" {
+					t.Errorf("expected an error with request_id %v but got %v", id, line)
+				}
+			}
+		})
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for s, expected := range map[string]slog.Level{"debug": slog.LevelDebug, "info": slog.LevelInfo, "WARN": slog.LevelWarn, "error": slog.LevelError} {
+		if actual, err := parseLogLevel(s); err != nil || actual != expected {
+			t.Errorf("expected %v to be %v but got %v, %v", s, expected, actual, err)
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Errorf("expected verbose to be rejected")
+	}
+}
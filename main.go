@@ -2,23 +2,126 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
 )
 
 func main() {
-	// For reviewing convenience, by default, this µs will load the sqlite csv dump onto a fresh `item` index.
-	// This is not at all the responsibility of this µs.
-	// A load balanced setup of replicas of this µs must always set the --no-replace-index flag.
-	// In normal operation, one would expect a different process constantly populating the ES `item` index.
-	var flagNoReplaceIndex = flag.Bool("no-replace-index", false, "whether to refresh the index on startup")
-	flag.Parse()
+	// See config.go for every option, and where they're read from
+	var cfg, args = mustLoadConfig(os.Args[1:])
+	var logLevel, _ = parseLogLevel(cfg.LogLevel) // already validated
+	setupLogging(os.Stderr, logLevel)
+	slog.Info("config: " + cfg.String())
 
-	// Retries up to 10 times with 1 second delay while waiting for ES to become operational
-	var db = mustNewDB("http://elasticsearch:9200", "elastic", "changeme", "item")
+	var esTLSConfig, err = newESTLSConfig(cfg)
+	if err != nil {
+		fatal(err.Error())
+	}
+	serverTLSConfig, err := newServerTLSConfig(cfg)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	// Spans always propagate to ES as traceparent, but are only exported with a trace exporter
+	exporter, err := newSpanExporter(cfg)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if exporter != nil {
+		defaultTracer.exporter = exporter
+		defer exporter.close() // flushes the spans of sync and report too
+	}
+
+	// /search needs an API key once any are configured, writes to /items always need one, and both are rate limited;
+	// see authenticator
+	auth, err := newAuthenticator(cfg)
+	if err != nil {
+		fatal(err.Error())
+	}
+	slog.Info("auth: loaded API keys", "keys", len(auth.keys), "allow_list", len(auth.allowList))
+	var cors = newCORSPolicy(cfg.CORSAllowedOrigins, cfg.CORSAllowedHeaders, cfg.CORSMaxAge.Duration)
+	// Requests go through every middleware in order, before endpointRoutes. Panics are recovered inside logging,
+	// tracing and metrics so that they see the 500, and CORS goes before auth so that preflights don't need a key.
+	var middlewares = []middleware{logRequests, traceRequests, instrumentHandler, recoverPanics, compress, cors.middleware, auth.middleware}
+
+	var validationConfig = defaultValidationConfig
+	if cfg.ValidationRules != "" {
+		validationConfig = mustReadValidationConfigFromFile(cfg.ValidationRules)
+	}
+	var validator = newValidator(validationConfig)
 
-	if !*flagNoReplaceIndex {
-		db.mustReplaceIndex(mustReadCSVFromFile("dump.csv"))
+	// `fl report [--live] [--json report.json] [dump.csv]` prints a data quality report of a dump or the live index, and exits
+	if len(args) > 0 && args[0] == "report" {
+		var (
+			reportFlags = flag.NewFlagSet("report", flag.ExitOnError)
+			flagLive    = reportFlags.Bool("live", false, "whether to report on the live index instead of a dump")
+			flagJSON    = reportFlags.String("json", "report.json", "where to write the machine-readable report")
+			flagCityKm  = reportFlags.Float64("city-radius-km", 50, "how far from its url's city an item can be")
+			items       []item
+		)
+		_ = reportFlags.Parse(args[1:])
+		if *flagLive {
+			var docs = mustNewDB(cfg.ESURL, cfg.ESUser, cfg.ESPassword, cfg.ESIndex, esTLSConfig, cfg.ESStartupTimeout.Duration, cfg.esResilience()).mustDocuments()
+			for _, id := range sortedIDs(docs) {
+				items = append(items, docs[id])
+			}
+		} else {
+			var path = cfg.Dump
+			if reportFlags.NArg() > 0 {
+				path = reportFlags.Arg(0)
+			}
+			items = mustReadCSVFromFile(path)
+		}
+		report := newQualityReport(items, *flagCityKm)
+		fmt.Print(report)
+		report.mustWriteJSON(*flagJSON)
+		return
 	}
 
-	serve(&http.Server{Addr: ":8080", Handler: newEndpointHandler(db)})
+	if cfg.Backend == "memory" {
+		if len(args) > 0 && args[0] == "sync" {
+			fatal("sync: the memory backend loads the dump on startup; there's nothing to sync")
+		}
+		items, _ := validator.validate(mustReadCSVFromFile(cfg.Dump))
+		var handler = newEndpointHandler(newMemoryStore(items))
+		handler.searchTimeout, handler.itemTimeout, handler.validator = cfg.SearchTimeout.Duration, cfg.ItemTimeout.Duration, validator
+		handler.v1Deprecation, handler.v1Sunset = cfg.V1Deprecation.Time, cfg.V1Sunset.Time
+		serve(&http.Server{Addr: cfg.Addr, Handler: chain(handler, middlewares...), TLSConfig: serverTLSConfig})
+		return
+	}
+
+	// Waits up to --es-startup-timeout, with backoff, for ES to be up and not red
+	var db = mustNewDB(cfg.ESURL, cfg.ESUser, cfg.ESPassword, cfg.ESIndex, esTLSConfig, cfg.ESStartupTimeout.Duration, cfg.esResilience())
+
+	// `fl sync [dump.csv]` only sends the changes between a new dump and the current index, and exits
+	if len(args) > 0 && args[0] == "sync" {
+		var path = cfg.Dump
+		if len(args) > 1 {
+			path = args[1]
+		}
+		items, _ := validator.validate(mustReadCSVFromFile(path))
+		res := db.mustSync(items)
+		slog.Info("sync: "+res.String(), "added", res.Added, "changed", res.Changed, "removed", res.Removed)
+		return
+	}
+
+	if !cfg.NoReplaceIndex {
+		items, _ := validator.validate(mustReadCSVFromFile(cfg.Dump))
+		db.mustReplaceIndex(items)
+	}
+	db.mustSetRefreshInterval(cfg.RefreshInterval.Duration)
+
+	var store itemStore = newCoalescingStore(db)
+	if cfg.CacheSize > 0 {
+		cache := newSearchCache(store, cfg.CacheSize, cfg.CacheTTL.Duration, cfg.CacheGeohashPrecision)
+		cache.refreshInterval = cfg.RefreshInterval.Duration
+		go cache.watchGeneration(cacheGenerationCheckInterval)
+		store = cache
+	}
+	var handler = newEndpointHandler(store)
+	handler.searchTimeout, handler.itemTimeout, handler.validator = cfg.SearchTimeout.Duration, cfg.ItemTimeout.Duration, validator
+	handler.v1Deprecation, handler.v1Sunset = cfg.V1Deprecation.Time, cfg.V1Sunset.Time
+	serve(&http.Server{Addr: cfg.Addr, Handler: chain(handler, middlewares...), TLSConfig: serverTLSConfig})
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// memoryStore is a pure-Go itemStore for local development, edge deployments and tests, where running
+// Elasticsearch isn't worth it. It mimics db.search: BM25 over the same english-analyzed fields, best field wins,
+// multiplied by the same gaussian distance decay. Everything lives in memory, so it's meant for small catalogues.
+type memoryStore struct {
+	mu     sync.RWMutex
+	docs   map[string]memoryDoc
+	seq    int // insertion order, to break ties like ES breaks them by doc order
+	fields [len(memoryFields)]memoryField
+	geo    spatialIndex
+}
+
+// memoryFields are the fields db.search matches searchTerm against, in the mapping's order
+var memoryFields = [...]func(it item) []string{
+	func(it item) []string { return []string{it.Name} },
+	func(it item) []string { return []string{it.URL} },
+	func(it item) []string { return it.ImgURLs },
+}
+
+type memoryDoc struct {
+	item    item
+	seq     int
+	lengths [len(memoryFields)]int
+}
+
+// memoryField is an inverted index of a field: term -> id -> term frequency
+type memoryField struct {
+	postings    map[string]map[string]int
+	totalLength int
+	docCount    int
+}
+
+// Parameters of db.search
+const (
+	memorySearchSize        = 20
+	memoryDecayOffsetMeters = 5000
+	memoryDecayScaleMeters  = 10000
+	bm25K1                  = 1.2
+	bm25B                   = 0.75
+)
+
+// memoryDecayCutoffMeters is where the gaussian decay goes below the smallest float32, which is what ES
+// scores are, so farther items score 0 there too. Items past it are still returned, last.
+var memoryDecayCutoffMeters = memoryDecayOffsetMeters + memoryDecayScaleMeters*math.Sqrt(-math.Log(math.SmallestNonzeroFloat32)/math.Ln2)
+
+var _ itemStore = &memoryStore{}
+
+// newMemoryStore returns a memoryStore with items put under their stable ids (see itemIDs)
+func newMemoryStore(items []item) *memoryStore {
+	s := &memoryStore{docs: make(map[string]memoryDoc), geo: newSpatialIndex()}
+	for i := range s.fields {
+		s.fields[i].postings = make(map[string]map[string]int)
+	}
+	for i, id := range itemIDs(items) {
+		s.putLocked(id, items[i])
+	}
+	return s
+}
+
+func (s *memoryStore) search(ctx context.Context, searchTerm string, loc location) (searchResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := ctx.Err(); err != nil { // e.g. the deadline passed while waiting for a write
+		return searchResult{items: []item{}}, fmt.Errorf("search: %w", err)
+	}
+
+	// Best field wins, like a multi_match query does by default
+	var (
+		terms     = analyzeEnglish(searchTerm)
+		textScore = make(map[string]float64)
+	)
+	for fi, f := range s.fields {
+		fieldScore := make(map[string]float64)
+		for _, term := range terms {
+			postings := f.postings[term]
+			if len(postings) == 0 {
+				continue
+			}
+			idf := math.Log(1 + (float64(f.docCount)-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+			avgLength := float64(f.totalLength) / float64(f.docCount)
+			for id, tf := range postings {
+				norm := bm25K1 * (1 - bm25B + bm25B*float64(s.docs[id].lengths[fi])/avgLength)
+				fieldScore[id] += idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + norm)
+			}
+		}
+		for id, score := range fieldScore {
+			textScore[id] = math.Max(textScore[id], score)
+		}
+	}
+
+	type hit struct {
+		id               string
+		score, textScore float64
+	}
+	var (
+		near = s.geo.within(loc, memoryDecayCutoffMeters)
+		hits = make([]hit, 0, len(textScore))
+	)
+	for id, score := range textScore {
+		var decay float64
+		if d, ok := near[id]; ok {
+			decay = gaussDecay(d, memoryDecayOffsetMeters, memoryDecayScaleMeters)
+		}
+		hits = append(hits, hit{id: id, score: score * decay, textScore: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		if hits[i].textScore != hits[j].textScore {
+			return hits[i].textScore > hits[j].textScore
+		}
+		return s.docs[hits[i].id].seq < s.docs[hits[j].id].seq
+	})
+
+	var (
+		items  = make([]item, 0, memorySearchSize)
+		ids    = make([]string, 0, memorySearchSize)
+		scores = make([]float64, 0, memorySearchSize)
+	)
+	for i := 0; i < len(hits) && i < memorySearchSize; i++ {
+		items = append(items, s.docs[hits[i].id].item)
+		ids = append(ids, hits[i].id)
+		scores = append(scores, hits[i].score)
+	}
+	return searchResult{items: items, ids: ids, scores: scores}, nil
+}
+
+func (s *memoryStore) get(ctx context.Context, id string) (item, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	doc, ok := s.docs[id]
+	if !ok {
+		return item{}, errItemNotFound
+	}
+	return doc.item, nil
+}
+
+// getVersion versions items by their seq, which every write of an item changes
+func (s *memoryStore) getVersion(ctx context.Context, id string) (item, itemVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	doc, ok := s.docs[id]
+	if !ok {
+		return item{}, itemVersion{}, errItemNotFound
+	}
+	return doc.item, itemVersion{seqNo: int64(doc.seq)}, nil
+}
+
+func (s *memoryStore) getMany(ctx context.Context, ids []string) (map[string]item, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := make(map[string]item, len(ids))
+	for _, id := range ids {
+		if doc, ok := s.docs[id]; ok {
+			items[id] = doc.item
+		}
+	}
+	return items, nil
+}
+
+func (s *memoryStore) create(ctx context.Context, id string, it item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.docs[id]; ok {
+		return errItemExists
+	}
+	s.putLocked(id, it)
+	return nil
+}
+
+func (s *memoryStore) put(ctx context.Context, id string, it item) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := s.docs[id]
+	s.putLocked(id, it)
+	return !exists, nil
+}
+
+func (s *memoryStore) update(ctx context.Context, id string, it item, version itemVersion) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if doc, ok := s.docs[id]; !ok || int64(doc.seq) != version.seqNo {
+		return errItemChanged
+	}
+	s.putLocked(id, it)
+	return nil
+}
+
+func (s *memoryStore) delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.docs[id]; !ok {
+		return errItemNotFound
+	}
+	s.deleteLocked(id)
+	return nil
+}
+
+func (s *memoryStore) putLocked(id string, it item) {
+	s.deleteLocked(id)
+	s.seq++
+	doc := memoryDoc{item: it, seq: s.seq}
+	for i, values := range memoryFields {
+		f := &s.fields[i]
+		for _, value := range values(it) {
+			for _, term := range analyzeEnglish(value) {
+				if f.postings[term] == nil {
+					f.postings[term] = make(map[string]int)
+				}
+				f.postings[term][id]++
+				doc.lengths[i]++
+			}
+		}
+		if doc.lengths[i] > 0 {
+			f.totalLength += doc.lengths[i]
+			f.docCount++
+		}
+	}
+	s.docs[id] = doc
+	s.geo.put(id, it.Location)
+}
+
+func (s *memoryStore) deleteLocked(id string) {
+	doc, ok := s.docs[id]
+	if !ok {
+		return
+	}
+	for i, values := range memoryFields {
+		f := &s.fields[i]
+		for _, value := range values(doc.item) {
+			for _, term := range analyzeEnglish(value) {
+				delete(f.postings[term], id)
+				if len(f.postings[term]) == 0 {
+					delete(f.postings, term)
+				}
+			}
+		}
+		if doc.lengths[i] > 0 {
+			f.totalLength -= doc.lengths[i]
+			f.docCount--
+		}
+	}
+	delete(s.docs, id)
+	s.geo.remove(id)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Memory store test runs the /search contract against a fresh memoryStore for every subtest.
+func TestMemoryStore(t *testing.T) {
+	for _, tc := range searchTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newMemoryStore(readTestItems(tc.items, tc.useCSVItems, t))
+			actualItems, actualStatusCode := testRequest(tc.httpMethod, tc.endpoint, tc.searchTerm, tc.lat, tc.lon, store, t)
+			if tc.expectedStatusCode != actualStatusCode {
+				t.Errorf("expected status code %v but got %v", tc.expectedStatusCode, actualStatusCode)
+				t.FailNow()
+			}
+			if tc.shardDependent && len(tc.expected) != len(actualItems) {
+				t.Errorf("expected %v items but got %v", len(tc.expected), len(actualItems))
+			}
+			if !tc.shardDependent && !reflect.DeepEqual(tc.expected, actualItems) {
+				t.Errorf("expected %v but got %#v", tc.expected, actualItems)
+			}
+		})
+	}
+}
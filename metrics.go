@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// Metrics are exposed on /metrics in the Prometheus text format (version 0.0.4). They're hand-rolled rather than
+// using the Prometheus client, since counters, gauges and histograms are all we need.
+var (
+	httpRequests         = newCounterVec("fl_http_requests_total", "HTTP requests by path and status code.", "path", "code")
+	httpDuration         = newHistogramVec("fl_http_request_duration_seconds", "HTTP request latency by path.", latencyBuckets, "path")
+	esDuration           = newHistogramVec("fl_es_request_duration_seconds", "Elasticsearch request latency by operation.", latencyBuckets, "operation")
+	esErrors             = newCounterVec("fl_es_errors_total", "Failed Elasticsearch requests by operation.", "operation")
+	searchResults        = newCounterVec("fl_search_results_total", "Items returned by searches.")
+	zeroResultSearches   = newCounterVec("fl_search_zero_results_total", "Searches that returned no items.")
+	bulkItems            = newCounterVec("fl_bulk_items_total", "Items sent in Elasticsearch bulk requests by operation and result (ok or failed).", "operation", "result")
+	bulkDuration         = newHistogramVec("fl_bulk_duration_seconds", "Elasticsearch bulk request latency by operation.", bulkBuckets, "operation")
+	esRetriesTotal       = newCounterVec("fl_es_retries_total", "Elasticsearch reads retried after a transient failure.")
+	esBreakerState       = newGaugeVec("fl_es_circuit_breaker_state", "State of the Elasticsearch circuit breaker: 0 closed, 1 half-open, 2 open.")
+	esBreakerRejections  = newCounterVec("fl_es_circuit_breaker_rejections_total", "Elasticsearch requests failed fast by the open circuit breaker.")
+	searchCacheLookups   = newCounterVec("fl_search_cache_lookups_total", "Search cache lookups by result (hit or miss).", "result")
+	searchCacheEvictions = newCounterVec("fl_search_cache_evictions_total", "Search cache entries evicted by reason (size, expired or invalidated).", "reason")
+	searchCacheEntries   = newGaugeVec("fl_search_cache_entries", "Searches in the search cache.")
+	coalescedSearches    = newCounterVec("fl_search_coalesced_total", "Searches that shared the result of an identical search in flight.")
+	apiRequests          = newCounterVec("fl_api_requests_total", "Searches by API version (v1 or v2) and path, to know when v1 can go.", "version", "path")
+	itemWrites           = newCounterVec("fl_item_writes_total", "Items written through /items by operation (create, replace, patch or delete).", "operation")
+	rejectedRequests     = newCounterVec("fl_http_rejected_total", "HTTP requests rejected by reason (unauthorized, forbidden, key_rate_limit or ip_rate_limit).", "reason")
+)
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	bulkBuckets    = []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+)
+
+// metricPaths are the paths with their own path label; every other path is "other", to bound the number of series
+var metricPaths = map[string]bool{"/search": true, "/v1/search": true, "/v2/search": true, "/items": true, "/healthz": true, "/readyz": true, "/metrics": true}
+
+// metric is a counter or histogram with labels, that writes itself in the text format
+type metric interface {
+	write(w io.Writer)
+}
+
+// registry is every metric, in order of creation
+var registry struct {
+	sync.Mutex
+	metrics []metric
+}
+
+func register(m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.metrics = append(registry.metrics, m)
+}
+
+// serveMetrics writes every metric in the text format
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
+
+func writeMetrics(w io.Writer) {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, m := range registry.metrics {
+		m.write(w)
+	}
+}
+
+// counterVec is a counter per combination of label values
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64 // by formatted labels, e.g. {path="/search",code="200"}
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// add adds v to the counter of labelValues, which are in the order of the counter's labels
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[formatLabels(c.labels, labelValues)]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%v%v %v\n", c.name, key, formatValue(c.values[key]))
+	}
+}
+
+// gaugeVec is a value that goes up and down per combination of label values
+type gaugeVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64 // by formatted labels
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(g)
+	return g
+}
+
+func (g *gaugeVec) set(v float64, labelValues ...string) {
+	key := formatLabels(g.labels, labelValues)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[key] = v
+}
+
+func (g *gaugeVec) value(labelValues ...string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[formatLabels(g.labels, labelValues)]
+}
+
+func (g *gaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n", g.name, g.help, g.name)
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%v%v %v\n", g.name, key, formatValue(g.values[key]))
+	}
+}
+
+// histogramVec is a histogram per combination of label values
+type histogramVec struct {
+	name, help string
+	buckets    []float64 // upper bounds, ascending; +Inf is implicit
+	labels     []string
+	mu         sync.Mutex
+	series     map[string]*histogram // by label values joined with \xff
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum         float64
+	count       uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, buckets: buckets, labels: labels, series: make(map[string]*histogram)}
+	register(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[sort.SearchFloat64s(h.buckets, v)]++ // the first bucket with an upper bound >= v
+	s.sum += v
+	s.count++
+}
+
+// observeSince observes the seconds since start
+func (h *histogramVec) observeSince(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[strings.Join(labelValues, "\xff")]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var (
+			s          = h.series[key]
+			labels     = append(append([]string{}, h.labels...), "le")
+			cumulative uint64
+		)
+		for i, upper := range append(append([]float64{}, h.buckets...), math.Inf(1)) {
+			cumulative += s.counts[i]
+			values := append(append([]string{}, s.labelValues...), formatValue(upper))
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, formatLabels(labels, values), cumulative)
+		}
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.name, formatLabels(h.labels, s.labelValues), formatValue(s.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.name, formatLabels(h.labels, s.labelValues), s.count)
+	}
+}
+
+// formatLabels formats label pairs like {path="/search",code="200"}, or "" without labels
+func formatLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+		pairs[i] = fmt.Sprintf("%v=\"%v\"", l, v)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return fmt.Sprint(v)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// instrumentHandler counts requests by path and status code, and observes their latency
+func instrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			start = time.Now()
+			rec   = &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+			path  = r.URL.Path
+		)
+		if !metricPaths[path] {
+			path = "other"
+		}
+		next.ServeHTTP(rec, r)
+		httpRequests.inc(path, fmt.Sprint(rec.code))
+		httpDuration.observeSince(start, path)
+	})
+}
+
+// observeBulk counts the items of a bulk request by whether they were indexed, and observes its latency.
+// Every item failed if the request itself did.
+func observeBulk(operation string, actions int, start time.Time, res *elastic.BulkResponse, err error) {
+	bulkDuration.observeSince(start, operation)
+	if err != nil || res == nil {
+		bulkItems.add(float64(actions), operation, "failed")
+		return
+	}
+	failed := len(res.Failed())
+	bulkItems.add(float64(actions-failed), operation, "ok")
+	bulkItems.add(float64(failed), operation, "failed")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogramVecWrite(t *testing.T) {
+	h := &histogramVec{name: "test_seconds", help: "Test.", buckets: []float64{.1, 1}, labels: []string{"path"}, series: make(map[string]*histogram)}
+	for _, v := range []float64{.05, .1, .5, 3} {
+		h.observe(v, `/a"b`)
+	}
+	var b strings.Builder
+	h.write(&b)
+	expected := `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{path="/a\"b",le="0.1"} 2
+test_seconds_bucket{path="/a\"b",le="1"} 3
+test_seconds_bucket{path="/a\"b",le="+Inf"} 4
+test_seconds_sum{path="/a\"b"} 3.65
+test_seconds_count{path="/a\"b"} 4
+`
+	if expected != b.String() {
+		t.Errorf("expected %v but got %v", expected, b.String())
+	}
+}
+
+// Metrics test makes requests through the instrumented handler, and expects them to be counted on /metrics.
+// Metrics are global, so it checks differences rather than absolute values.
+func TestMetrics(t *testing.T) {
+	var (
+		es      = newFakeES(fakeES6, t)
+		db      = es.newDB("items", t)
+		handler = instrumentHandler(newEndpointHandler(db))
+		empty   = instrumentHandler(newEndpointHandler(newMemoryStore(nil)))
+		request = func(h http.Handler, target string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+			return w
+		}
+		before = map[string]float64{
+			"ok":       httpRequests.value("/search", "200"),
+			"notFound": httpRequests.value("other", "404"),
+			"failed":   httpRequests.value("/search", "500"),
+			"results":  searchResults.value(),
+			"zero":     zeroResultSearches.value(),
+			"esErrors": esErrors.value("search"),
+			"bulkOK":   bulkItems.value("insert", "ok"),
+		}
+		searches   = httpDuration.count("/search")
+		esSearches = esDuration.count("search")
+	)
+	loadItemsIntoTestIndex(`"camera",51,0,london/camera-1,[]
+"tripod",51,0,london/tripod-2,[]`, false, db, t)
+	request(handler, "/search?searchTerm=camera&lat=51&lng=0")
+	request(empty, "/search?searchTerm=camera&lat=51&lng=0")
+	request(handler, "/nope")
+	db.deleteIndex()
+	request(handler, "/search?searchTerm=camera&lat=51&lng=0")
+
+	for name, offBy := range map[string]float64{
+		"ok":       httpRequests.value("/search", "200") - before["ok"] - 2,
+		"notFound": httpRequests.value("other", "404") - before["notFound"] - 1,
+		"failed":   httpRequests.value("/search", "500") - before["failed"] - 1,
+		"results":  searchResults.value() - before["results"] - 2,
+		"zero":     zeroResultSearches.value() - before["zero"] - 1,
+		"esErrors": esErrors.value("search") - before["esErrors"] - 1,
+		"bulkOK":   bulkItems.value("insert", "ok") - before["bulkOK"] - 2,
+	} {
+		if offBy != 0 {
+			t.Errorf("expected %v to be counted but it's off by %v", name, offBy)
+		}
+	}
+	if actual := httpDuration.count("/search") - searches; actual != 3 {
+		t.Errorf("expected 3 /search latencies but got %v", actual)
+	}
+	if actual := esDuration.count("search") - esSearches; actual != 2 {
+		t.Errorf("expected 2 ES search latencies but got %v", actual)
+	}
+
+	w := request(handler, "/metrics")
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("expected the Prometheus text format but got %v", ct)
+	}
+	for _, expected := range []string{
+		"# TYPE fl_http_requests_total counter\n",
+		`fl_http_requests_total{path="/search",code="200"} `,
+		`fl_http_request_duration_seconds_bucket{path="/search",le="+Inf"} `,
+		`fl_es_request_duration_seconds_count{operation="search"} `,
+		`fl_es_errors_total{operation="search"} `,
+		"fl_search_zero_results_total ",
+		`fl_bulk_items_total{operation="insert",result="ok"} `,
+		`fl_bulk_duration_seconds_count{operation="insert"} `,
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("expected /metrics to contain %q but got %v", expected, w.Body)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Chain test expects middlewares to see requests in the order they're given.
+func TestChain(t *testing.T) {
+	var seen []string
+	mark := func(name string) middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = append(seen, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	h := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = append(seen, "handler") }),
+		mark("first"), mark("second"), mark("third"))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if expected := []string{"first", "second", "third", "handler"}; !reflect.DeepEqual(expected, seen) {
+		t.Errorf("expected %v but got %v", expected, seen)
+	}
+}
+
+// Recovery test expects a panicking handler to answer a 500 error body, which the middlewares around it see.
+func TestRecoverPanics(t *testing.T) {
+	var (
+		w = httptest.NewRecorder()
+		h = chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { panic("boom") }), logRequests, recoverPanics)
+	)
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/search", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status code %v but got %v", http.StatusInternalServerError, w.Code)
+	}
+	var body errorBody
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Code != "internal_error" || body.RequestID == "" {
+		t.Errorf("expected an internal_error with a request id but got %v %v", body, err)
+	}
+}
+
+// Compression test expects responses to be gzipped for clients that accept it, and only for them.
+func TestCompress(t *testing.T) {
+	var (
+		camera  = item{"camera", location{51, 0}, "london/camera", []string{}}
+		handler = compress(newEndpointHandler(&fakeStore{items: []item{camera}}))
+	)
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		target         string
+		expectedGzip   bool
+	}{
+		{name: "gzip", acceptEncoding: "gzip", target: "/search?searchTerm=camera&lat=51&lng=0", expectedGzip: true},
+		{name: "among others", acceptEncoding: "br;q=1.0, gzip;q=0.8, *;q=0.1", target: "/search?searchTerm=camera&lat=51&lng=0", expectedGzip: true},
+		{name: "errors too", acceptEncoding: "gzip", target: "/search", expectedGzip: true},
+		{name: "not accepted", acceptEncoding: "", target: "/search?searchTerm=camera&lat=51&lng=0"},
+		{name: "refused", acceptEncoding: "gzip;q=0, deflate", target: "/search?searchTerm=camera&lat=51&lng=0"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				w            = httptest.NewRecorder()
+				uncompressed = httptest.NewRecorder()
+				r            = httptest.NewRequest("GET", tc.target, nil)
+			)
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			handler.ServeHTTP(w, r)
+			newEndpointHandler(&fakeStore{items: []item{camera}}).ServeHTTP(uncompressed, httptest.NewRequest("GET", tc.target, nil))
+			if w.Code != uncompressed.Code {
+				t.Errorf("expected status code %v but got %v", uncompressed.Code, w.Code)
+			}
+			if !strings.Contains(w.Header().Get("Vary"), "Accept-Encoding") {
+				t.Errorf("expected Vary: Accept-Encoding but got %q", w.Header().Get("Vary"))
+			}
+			var body io.Reader = w.Body
+			if actual := w.Header().Get("Content-Encoding") == "gzip"; actual != tc.expectedGzip {
+				t.Fatalf("expected gzip %v but got Content-Encoding %q", tc.expectedGzip, w.Header().Get("Content-Encoding"))
+			}
+			if tc.expectedGzip {
+				gz, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatalf("couldn't read gzip: %v", err)
+				}
+				body = gz
+			}
+			actual, _ := io.ReadAll(body)
+			if expected := uncompressed.Body.String(); string(actual) != expected {
+				t.Errorf("expected %q but got %q", expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// qualityReport lists the items in a catalogue that are likely to need a human looking at them
+type qualityReport struct {
+	Items         int              `json:"items"`
+	Duplicates    []duplicateGroup `json:"duplicates"`
+	NoImages      []item           `json:"no_images"`
+	CityOutliers  []cityOutlier    `json:"city_outliers"`
+	CodeLikeNames []item           `json:"code_like_names"`
+}
+
+// duplicateGroup is items with the same name within duplicateRadiusMeters of the first one
+type duplicateGroup struct {
+	Name  string `json:"name"`
+	Items []item `json:"items"`
+}
+
+// cityOutlier is an item farther than the report's city radius from the city in its url (e.g. london/...)
+type cityOutlier struct {
+	Item       item    `json:"item"`
+	City       string  `json:"city"`
+	DistanceKm float64 `json:"distance_km"`
+}
+
+const duplicateRadiusMeters = 50
+
+// cityCentres are the city slugs in the catalogue's urls. Unknown cities fall back to the median location of
+// their items, as long as there are enough of them for the median to mean something.
+var cityCentres = map[string]location{
+	"aberdeen":       {Lat: 57.1497, Lon: -2.0943},
+	"bath":           {Lat: 51.3811, Lon: -2.3590},
+	"belfast":        {Lat: 54.5973, Lon: -5.9301},
+	"birmingham":     {Lat: 52.4862, Lon: -1.8904},
+	"brighton":       {Lat: 50.8225, Lon: -0.1372},
+	"bristol":        {Lat: 51.4545, Lon: -2.5879},
+	"cambridge":      {Lat: 52.2053, Lon: 0.1218},
+	"canterbury":     {Lat: 51.2802, Lon: 1.0789},
+	"cardiff":        {Lat: 51.4816, Lon: -3.1791},
+	"carlisle":       {Lat: 54.8925, Lon: -2.9329},
+	"coventry":       {Lat: 52.4068, Lon: -1.5197},
+	"exeter":         {Lat: 50.7184, Lon: -3.5339},
+	"glasgow":        {Lat: 55.8642, Lon: -4.2518},
+	"hove":           {Lat: 50.8279, Lon: -0.1688},
+	"lancaster":      {Lat: 54.0466, Lon: -2.8007},
+	"leeds":          {Lat: 53.8008, Lon: -1.5491},
+	"london":         {Lat: 51.5074, Lon: -0.1278},
+	"los-angeles":    {Lat: 34.0522, Lon: -118.2437},
+	"manchester":     {Lat: 53.4808, Lon: -2.2426},
+	"norwich":        {Lat: 52.6309, Lon: 1.2974},
+	"oxford":         {Lat: 51.7520, Lon: -1.2577},
+	"plymouth":       {Lat: 50.3755, Lon: -4.1427},
+	"portsmouth":     {Lat: 50.8198, Lon: -1.0880},
+	"preston":        {Lat: 53.7632, Lon: -2.7031},
+	"salford":        {Lat: 53.4875, Lon: -2.2901},
+	"salisbury":      {Lat: 51.0688, Lon: -1.7945},
+	"sheffield":      {Lat: 53.3811, Lon: -1.4701},
+	"stoke-on-trent": {Lat: 53.0027, Lon: -2.1794},
+	"swansea":        {Lat: 51.6214, Lon: -3.9436},
+	"wakefield":      {Lat: 53.6833, Lon: -1.4977},
+	"winchester":     {Lat: 51.0632, Lon: -1.3080},
+	"wolverhampton":  {Lat: 52.5862, Lon: -2.1288},
+	"york":           {Lat: 53.9600, Lon: -1.0873},
+}
+
+// newQualityReport runs every check over items. cityRadiusKm is how far from its url's city an item can be.
+func newQualityReport(items []item, cityRadiusKm float64) qualityReport {
+	var (
+		report = qualityReport{Items: len(items), Duplicates: []duplicateGroup{}, NoImages: []item{}, CityOutliers: []cityOutlier{}, CodeLikeNames: []item{}}
+		groups []*duplicateGroup
+		byName = make(map[string][]*duplicateGroup)
+		byCity = make(map[string][]item)
+	)
+	for _, it := range items {
+		var name, grouped = normalizeName(it.Name), false
+		for _, group := range byName[name] {
+			if distanceMeters(it.Location, group.Items[0].Location) <= duplicateRadiusMeters {
+				group.Items, grouped = append(group.Items, it), true
+				break
+			}
+		}
+		if !grouped {
+			group := &duplicateGroup{Name: it.Name, Items: []item{it}}
+			groups, byName[name] = append(groups, group), append(byName[name], group)
+		}
+
+		if len(it.ImgURLs) == 0 {
+			report.NoImages = append(report.NoImages, it)
+		}
+		if isCodeLikeName(it.Name) {
+			report.CodeLikeNames = append(report.CodeLikeNames, it)
+		}
+		if i := strings.Index(it.URL, "/"); i > 0 {
+			byCity[it.URL[:i]] = append(byCity[it.URL[:i]], it)
+		}
+	}
+
+	for _, group := range groups {
+		if len(group.Items) > 1 {
+			report.Duplicates = append(report.Duplicates, *group)
+		}
+	}
+	for city, cityItems := range byCity {
+		centre, ok := cityCentres[city]
+		if !ok && len(cityItems) >= 3 {
+			centre, ok = medianLocation(cityItems), true
+		}
+		if !ok {
+			continue
+		}
+		for _, it := range cityItems {
+			if d := distanceMeters(it.Location, centre) / 1000; d > cityRadiusKm {
+				report.CityOutliers = append(report.CityOutliers, cityOutlier{Item: it, City: city, DistanceKm: d})
+			}
+		}
+	}
+	sort.Slice(report.CityOutliers, func(i, j int) bool {
+		return report.CityOutliers[i].DistanceKm > report.CityOutliers[j].DistanceKm
+	})
+	return report
+}
+
+func (r qualityReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "report: %v items\n", r.Items)
+	fmt.Fprintf(&b, "\n%v duplicated listings (same name within %vm):\n", len(r.Duplicates), duplicateRadiusMeters)
+	for _, d := range r.Duplicates {
+		urls := make([]string, len(d.Items))
+		for i, it := range d.Items {
+			urls[i] = it.URL
+		}
+		fmt.Fprintf(&b, "  %q x%v: %v\n", d.Name, len(d.Items), strings.Join(urls, ", "))
+	}
+	fmt.Fprintf(&b, "\n%v items with no images:\n", len(r.NoImages))
+	for _, it := range r.NoImages {
+		fmt.Fprintf(&b, "  %q: %v\n", it.Name, it.URL)
+	}
+	fmt.Fprintf(&b, "\n%v items far from their url's city:\n", len(r.CityOutliers))
+	for _, o := range r.CityOutliers {
+		fmt.Fprintf(&b, "  %q: %v is %.0fkm away from %v\n", o.Item.Name, o.Item.URL, o.DistanceKm, o.City)
+	}
+	fmt.Fprintf(&b, "\n%v names that are mostly punctuation or codes:\n", len(r.CodeLikeNames))
+	for _, it := range r.CodeLikeNames {
+		fmt.Fprintf(&b, "  %q: %v\n", it.Name, it.URL)
+	}
+	return b.String()
+}
+
+func (r qualityReport) mustWriteJSON(path string) {
+	if err := r.writeJSON(path); err != nil {
+		fatal(err.Error())
+	}
+}
+
+func (r qualityReport) writeJSON(path string) error {
+	fh, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("writeJSON: error creating file: %v", err)
+	}
+	defer fh.Close()
+	enc := json.NewEncoder(fh)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		return fmt.Errorf("writeJSON: error encoding report: %v", err)
+	}
+	return nil
+}
+
+// sortedIDs returns the ids of docs in order, so that reports on the live index are stable
+func sortedIDs(docs map[string]item) []string {
+	ids := make([]string, 0, len(docs))
+	for id := range docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func normalizeName(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+// isCodeLikeName is true for names that are mostly punctuation (e.g. "....."),
+// or that don't have a single word of 3+ letters (e.g. "XT2 / A7").
+func isCodeLikeName(name string) bool {
+	var alphanumerics, punctuation int
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			alphanumerics++
+		case !unicode.IsSpace(r):
+			punctuation++
+		}
+	}
+	if punctuation >= alphanumerics {
+		return true
+	}
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		if len([]rune(word)) >= 3 {
+			return false
+		}
+	}
+	return true
+}
+
+func medianLocation(items []item) location {
+	var lats, lons = make([]float64, len(items)), make([]float64, len(items))
+	for i, it := range items {
+		lats[i], lons[i] = it.Location.Lat, it.Location.Lon
+	}
+	sort.Float64s(lats)
+	sort.Float64s(lons)
+	return location{Lat: lats[len(lats)/2], Lon: lons[len(lons)/2]}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQualityReport(t *testing.T) {
+	items, err := readCSV(strings.NewReader(`"Canon 7D Camera",51.5,-0.1,london/hire-canon-7d-1,"[""a.jpg""]"
+"canon 7d  camera",51.5002,-0.1,london/hire-canon-7d-2,"[""b.jpg""]"
+"Canon 7D Camera",51.6,-0.1,london/hire-canon-7d-3,"[""c.jpg""]"
+"Tripod",51.5,-0.1,london/hire-tripod-4,[]
+"..........",51.5,-0.1,london/hire-lens-5,"[""d.jpg""]"
+"Drone",51.5,-0.1,los-angeles/hire-drone-6,"[""e.jpg""]"`))
+	if err != nil {
+		t.Fatalf("couldn't read items: %v", err)
+	}
+	report := newQualityReport(items, 50)
+	if len(report.Duplicates) != 1 || len(report.Duplicates[0].Items) != 2 {
+		t.Errorf("expected the first two cameras to be duplicates but got %v", report.Duplicates)
+	}
+	if len(report.NoImages) != 1 || report.NoImages[0].Name != "Tripod" {
+		t.Errorf("expected the tripod to have no images but got %v", report.NoImages)
+	}
+	if len(report.CityOutliers) != 1 || report.CityOutliers[0].City != "los-angeles" {
+		t.Errorf("expected the drone to be far from its city but got %v", report.CityOutliers)
+	}
+	if len(report.CodeLikeNames) != 1 || report.CodeLikeNames[0].URL != "london/hire-lens-5" {
+		t.Errorf("expected the lens to have a code-like name but got %v", report.CodeLikeNames)
+	}
+}
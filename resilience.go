@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ES requests go through retryTransport, which retries idempotent reads on transient failures, and breakerTransport,
+// which fails every request fast while ES looks down, instead of piling up requests that would time out anyway.
+
+// esResilience is how ES requests are retried and when they start failing fast; see the es-retry and es-breaker
+// options of config
+type esResilience struct {
+	// retries is how many times an idempotent read is retried, with exponential backoff from retryBaseDelay
+	// up to retryMaxDelay, and full jitter so that replicas don't retry in lockstep
+	retries        int
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+	// breakerThreshold consecutive failures open the circuit breaker, which lets a probe request through after
+	// breakerCooldown
+	breakerThreshold int
+	breakerCooldown  time.Duration
+}
+
+var errCircuitOpen = errors.New("circuit breaker open: elasticsearch is failing")
+
+// backoff is how long to wait before retry number attempt (from 1): a random duration up to base doubled
+// attempt-1 times, capped at max
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	d := base << (attempt - 1)
+	if d > max || d <= 0 {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryTransport retries idempotent reads (see retryable) on network errors and on 429, 502, 503 and 504,
+// as long as their context's deadline allows
+type retryTransport struct {
+	next       http.RoundTripper
+	resilience esResilience
+}
+
+// retryable is true for reads: GET and HEAD, and searches and counts, which POST their query.
+// Scrolls are left out, since retrying them would open a scroll context or skip a page.
+func retryable(req *http.Request) bool {
+	switch {
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		return true
+	case req.Method != http.MethodPost || req.URL.Query().Has("scroll"):
+		return false
+	}
+	return strings.HasSuffix(req.URL.Path, "/_search") || strings.HasSuffix(req.URL.Path, "/_count")
+}
+
+// transient is true for failures that may well not happen again, e.g. a node restarting
+func transient(res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !retryable(req) {
+		return t.next.RoundTrip(req)
+	}
+	var body []byte
+	if req.Body != nil { // read once, so that every attempt sends it
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("retryTransport: error reading request body: %v", err)
+		}
+		body = b
+	}
+	for attempt := 0; ; attempt++ {
+		if body != nil {
+			req = req.Clone(req.Context())
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		res, err := t.next.RoundTrip(req)
+		if attempt == t.resilience.retries || !transient(res, err) {
+			return res, err
+		}
+		wait := backoff(attempt+1, t.resilience.retryBaseDelay, t.resilience.retryMaxDelay)
+		if deadline, ok := req.Context().Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return res, err
+		}
+		if res != nil {
+			_, _ = io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		esRetriesTotal.inc()
+		slog.DebugContext(req.Context(), "retryTransport: retrying", "method", req.Method, "path", req.URL.Path,
+			"attempt", attempt+1, "wait_ms", wait.Milliseconds())
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	return [...]string{"closed", "half-open", "open"}[s]
+}
+
+// circuitBreaker opens after threshold consecutive failures, and then rejects requests for cooldown.
+// After that, it's half-open: a single probe request goes through, which closes it if it succeeds, or opens it
+// again if it fails.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	esBreakerState.set(float64(breakerClosed))
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns errCircuitOpen if a request shouldn't go through. Requests that go through must be recorded.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		b.transition(breakerHalfOpen)
+	}
+	switch {
+	case b.state == breakerOpen, b.state == breakerHalfOpen && b.probing:
+		esBreakerRejections.inc()
+		return errCircuitOpen
+	case b.state == breakerHalfOpen:
+		b.probing = true
+	}
+	return nil
+}
+
+// record counts the outcome of a request that allow let through
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.transition(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.transition(breakerOpen)
+	}
+}
+
+// abandon forgets a request that allow let through but that didn't get an answer either way
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) transition(to breakerState) {
+	if b.state == to {
+		return
+	}
+	slog.Warn("circuitBreaker: "+to.String(), "from", b.state.String(), "failures", b.failures)
+	b.state = to
+	esBreakerState.set(float64(to))
+}
+
+func (b *circuitBreaker) current() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// breakerTransport sends requests through a circuitBreaker, once newDB has connected; until then, ES is expected
+// to be down. Network errors and 502, 503 and 504 count as failures, unlike e.g. a 404 for a missing index.
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *circuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.breaker == nil {
+		return t.next.RoundTrip(req)
+	}
+	if err := t.breaker.allow(); err != nil {
+		return nil, err
+	}
+	res, err := t.next.RoundTrip(req)
+	switch {
+	case errors.Is(err, context.Canceled): // the client went away, which says nothing about ES
+		t.breaker.abandon()
+	case err != nil:
+		t.breaker.record(true)
+	default:
+		t.breaker.record(res.StatusCode == http.StatusBadGateway || res.StatusCode == http.StatusServiceUnavailable ||
+			res.StatusCode == http.StatusGatewayTimeout)
+	}
+	return res, err
+}
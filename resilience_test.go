@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripperFunc is an http.RoundTripper out of a function
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// fastResilience is the default esResilience with millisecond backoff, so that tests don't wait on retries
+func fastResilience() esResilience {
+	resilience := defaultConfig.esResilience()
+	resilience.retryBaseDelay = time.Millisecond
+	return resilience
+}
+
+// Retry test sends requests through a retryTransport to a backend that fails a few times, and expects only
+// idempotent reads to be retried, with the same body, until they succeed or run out of retries.
+func TestRetryTransport(t *testing.T) {
+	errNetwork := errors.New("connection refused")
+	tests := []struct {
+		name             string
+		method, target   string
+		failures         []interface{} // status codes or errors, before a 200
+		expectedAttempts int
+		expectedStatus   int
+	}{
+		{name: "search retried", method: "POST", target: "/items/_search", failures: []interface{}{503, errNetwork}, expectedAttempts: 3, expectedStatus: 200},
+		{name: "get retried", method: "GET", target: "/_cluster/health", failures: []interface{}{502}, expectedAttempts: 2, expectedStatus: 200},
+		{name: "too many requests retried", method: "HEAD", target: "/items", failures: []interface{}{429}, expectedAttempts: 2, expectedStatus: 200},
+		{name: "retries run out", method: "POST", target: "/items/_count", failures: []interface{}{503, 503, 503, 503, 503}, expectedAttempts: 4, expectedStatus: 503},
+		{name: "client errors not retried", method: "POST", target: "/items/_search", failures: []interface{}{400}, expectedAttempts: 1, expectedStatus: 400},
+		{name: "bulk not retried", method: "POST", target: "/_bulk", failures: []interface{}{503}, expectedAttempts: 1, expectedStatus: 503},
+		{name: "scroll not retried", method: "POST", target: "/items/_search?scroll=1m", failures: []interface{}{503}, expectedAttempts: 1, expectedStatus: 503},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				attempts  int
+				transport = retryTransport{next: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					attempts++
+					if body, _ := io.ReadAll(req.Body); string(body) != `{"size":20}` {
+						t.Errorf("expected every attempt to send the body but got %q", body)
+					}
+					if attempts > len(tc.failures) {
+						return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+					}
+					if err, ok := tc.failures[attempts-1].(error); ok {
+						return nil, err
+					}
+					return &http.Response{StatusCode: tc.failures[attempts-1].(int), Body: http.NoBody}, nil
+				}), resilience: fastResilience()}
+				body = io.NopCloser(strings.NewReader(`{"size":20}`))
+				req  = httptest.NewRequest(tc.method, tc.target, body)
+			)
+			res, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Errorf("expected a response but got %v", err)
+				t.FailNow()
+			}
+			if res.StatusCode != tc.expectedStatus || attempts != tc.expectedAttempts {
+				t.Errorf("expected %v after %v attempts but got %v after %v", tc.expectedStatus, tc.expectedAttempts, res.StatusCode, attempts)
+			}
+		})
+	}
+}
+
+// Circuit breaker test walks a breaker through opening, failing fast, probing and closing.
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(3, 20*time.Millisecond)
+	expect := func(state breakerState, allowed bool) {
+		t.Helper()
+		err := b.allow()
+		if b.current() != state || (err == nil) != allowed {
+			t.Errorf("expected %v and allowed %v but got %v and %v", state, allowed, b.current(), err)
+			t.FailNow()
+		}
+	}
+	for i := 0; i < 2; i++ {
+		expect(breakerClosed, true)
+		b.record(true)
+	}
+	expect(breakerClosed, true)
+	b.record(false) // successes reset the count
+	for i := 0; i < 3; i++ {
+		expect(breakerClosed, true)
+		b.record(true)
+	}
+	expect(breakerOpen, false)
+	if esBreakerState.value() != float64(breakerOpen) {
+		t.Errorf("expected the state metric to be open but got %v", esBreakerState.value())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	expect(breakerHalfOpen, true)
+	expect(breakerHalfOpen, false) // a single probe at a time
+	b.record(true)
+	expect(breakerOpen, false)
+
+	time.Sleep(20 * time.Millisecond)
+	expect(breakerHalfOpen, true)
+	b.record(false)
+	expect(breakerClosed, true)
+}
+
+// Resilience test searches a fakeES whose searches fail, and expects transient failures to be retried away, and
+// persistent ones to open the breaker, which then fails searches without sending them to ES, as configured.
+func TestSearchResilience(t *testing.T) {
+	resilience := fastResilience()
+	resilience.retries, resilience.breakerThreshold = 1, 2
+	es := newFakeES(fakeES6, t)
+	db, err := newDB(es.URL, "elastic", "changeme", "items", nil, 5*time.Second, resilience)
+	if err != nil {
+		t.Errorf("can't connect to fake ES: %v", err)
+		t.FailNow()
+	}
+	t.Cleanup(db.client.Stop)
+	var (
+		search = func() int {
+			w := httptest.NewRecorder()
+			newEndpointHandler(db).ServeHTTP(w, httptest.NewRequest("GET", "/search?searchTerm=camera&lat=51&lng=0", nil))
+			return w.Code
+		}
+	)
+	loadItemsIntoTestIndex(`"camera",51,0,london/camera,[]`, false, db, t)
+
+	es.searchFailures = resilience.retries
+	if actual := search(); actual != http.StatusOK || len(es.received("POST", "/_search")) != resilience.retries+1 {
+		t.Errorf("expected the search to succeed on its last retry but got %v after %v attempts", actual, len(es.received("POST", "/_search")))
+	}
+
+	es.mu.Lock()
+	es.searchFailures = 1000
+	es.mu.Unlock()
+	for i := 0; i < resilience.breakerThreshold; i++ {
+		if actual := search(); actual != http.StatusInternalServerError {
+			t.Errorf("expected the search to fail but got %v", actual)
+		}
+	}
+	if db.breaker.current() != breakerOpen {
+		t.Errorf("expected the breaker to open after %v failed searches but it's %v", resilience.breakerThreshold, db.breaker.current())
+	}
+	sent := len(es.received("POST", "/_search"))
+	if actual := search(); actual != http.StatusInternalServerError || len(es.received("POST", "/_search")) != sent {
+		t.Errorf("expected the search to fail fast but got %v after sending %v more", actual, len(es.received("POST", "/_search"))-sent)
+	}
+}
+
+// Startup test expects newDB to wait for a red cluster to recover, and to give up on it after the startup timeout.
+func TestNewDBWaitsForCluster(t *testing.T) {
+	es := newFakeES(fakeES6, t)
+	es.health = "red"
+	if _, err := newDB(es.URL, "elastic", "changeme", "items", nil, 100*time.Millisecond, fastResilience()); err == nil || !strings.Contains(err.Error(), "is red") {
+		t.Errorf("expected newDB to give up on a red cluster but got %v", err)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		es.mu.Lock()
+		defer es.mu.Unlock()
+		es.health = "yellow"
+	}()
+	db, err := newDB(es.URL, "elastic", "changeme", "items", nil, 10*time.Second, fastResilience())
+	if err != nil {
+		t.Errorf("expected newDB to wait for the cluster but got %v", err)
+		t.FailNow()
+	}
+	db.client.Stop()
+}
+
+// Hung cluster test expects newDB to give up on a node that accepts requests but never answers them once the startup
+// timeout passed, rather than wait for it forever.
+func TestNewDBHungCluster(t *testing.T) {
+	release := make(chan struct{})
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead { // the client's own health check
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer es.Close()
+	defer close(release)
+
+	start := time.Now()
+	if _, err := newDB(es.URL, "elastic", "changeme", "items", nil, 300*time.Millisecond, fastResilience()); err == nil {
+		t.Errorf("expected newDB to give up on a hung cluster")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected newDB to give up after its 300ms startup timeout but it took %v", elapsed)
+	}
+}
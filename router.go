@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// route is an endpoint of endpointHandler: a method and a path pattern like /items/{id}, whose {name} segments
+// match any non-empty segment and are the route's path params. Its middlewares only wrap it, after the route matched.
+type route struct {
+	method      string
+	pattern     string
+	handle      func(eh endpointHandler, w http.ResponseWriter, r *http.Request)
+	middlewares []middleware
+
+	segments []string
+}
+
+// router finds the route of a request. Routes are tried in order, so static routes go before overlapping
+// parameterized ones.
+type router struct {
+	routes []route
+}
+
+func newRouter(routes ...route) router {
+	for i := range routes {
+		if !strings.HasPrefix(routes[i].pattern, "/") {
+			panic(fmt.Sprintf("newRouter: pattern %q doesn't start with /", routes[i].pattern))
+		}
+		routes[i].segments = strings.Split(routes[i].pattern, "/")
+	}
+	return router{routes: routes}
+}
+
+// match returns the route of method and the escaped path, and its path params. If there's none, allowed is the
+// methods of the routes of path, if any.
+func (rt router) match(method, path string) (match *route, params map[string]string, allowed []string) {
+	segments := strings.Split(path, "/")
+	for i := range rt.routes {
+		r := &rt.routes[i]
+		p, ok := r.matchPath(segments)
+		if !ok {
+			continue
+		}
+		if r.method == method {
+			return r, p, nil
+		}
+		allowed = append(allowed, r.method)
+	}
+	return nil, nil, allowed
+}
+
+func (r *route) matchPath(segments []string) (map[string]string, bool) {
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, s := range r.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			v, err := url.PathUnescape(segments[i])
+			if err != nil || v == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[s[1:len(s)-1]] = v
+		} else if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+type pathParamsKey struct{}
+
+func withPathParams(ctx context.Context, params map[string]string) context.Context {
+	return context.WithValue(ctx, pathParamsKey{}, params)
+}
+
+// pathParam is the value of the {name} segment of the route of r
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+// serveRoute serves r with the matching route of rt, or answers 404, or 405 with the methods the path allows
+func (rt router) serveRoute(eh endpointHandler, w http.ResponseWriter, r *http.Request) {
+	match, params, allowed := rt.match(r.Method, r.URL.EscapedPath())
+	switch {
+	case match != nil:
+		if params != nil {
+			r = r.WithContext(withPathParams(r.Context(), params))
+		}
+		if span := spanFrom(r.Context()); span != nil && span.kind == spanKindServer {
+			span.setRoute(r.Method, match.pattern)
+		}
+		chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { match.handle(eh, w, r) }), match.middlewares...).ServeHTTP(w, r)
+	case len(allowed) > 0:
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, r, http.StatusMethodNotAllowed, apiError{Code: "method_not_allowed", Message: r.Method + " isn't allowed, only " + strings.Join(allowed, ", ")})
+	default:
+		writeError(w, r, http.StatusNotFound, apiError{Code: "not_found", Message: r.URL.Path + " doesn't exist"})
+	}
+}
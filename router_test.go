@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Router test matches requests against static and parameterized routes, and expects 404 for unknown paths and 405
+// with Allow for known paths with another method.
+func TestRouter(t *testing.T) {
+	handle := func(name string) func(endpointHandler, http.ResponseWriter, *http.Request) {
+		return func(_ endpointHandler, w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%v id=%v", name, pathParam(r, "id"))
+		}
+	}
+	rt := newRouter(
+		route{method: http.MethodGet, pattern: "/items/new", handle: handle("new")},
+		route{method: http.MethodGet, pattern: "/items/{id}", handle: handle("get")},
+		route{method: http.MethodDelete, pattern: "/items/{id}", handle: handle("delete")},
+		route{method: http.MethodGet, pattern: "/items", handle: handle("list")},
+	)
+	tests := []struct {
+		method, target     string
+		expected           string
+		expectedStatusCode int
+		expectedAllow      string
+	}{
+		{method: "GET", target: "/items", expected: "list id=", expectedStatusCode: http.StatusOK},
+		{method: "GET", target: "/items/42", expected: "get id=42", expectedStatusCode: http.StatusOK},
+		{method: "DELETE", target: "/items/42", expected: "delete id=42", expectedStatusCode: http.StatusOK},
+		{method: "GET", target: "/items/new", expected: "new id=", expectedStatusCode: http.StatusOK},
+		{method: "GET", target: "/items/london%2Fcamera", expected: "get id=london/camera", expectedStatusCode: http.StatusOK},
+		{method: "PUT", target: "/items/42", expectedStatusCode: http.StatusMethodNotAllowed, expectedAllow: "GET, DELETE"},
+		{method: "POST", target: "/items", expectedStatusCode: http.StatusMethodNotAllowed, expectedAllow: "GET"},
+		{method: "GET", target: "/items/", expectedStatusCode: http.StatusNotFound},
+		{method: "GET", target: "/items/42/", expectedStatusCode: http.StatusNotFound},
+		{method: "GET", target: "/items/42/images", expectedStatusCode: http.StatusNotFound},
+		{method: "GET", target: "/", expectedStatusCode: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.method+" "+tc.target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			rt.serveRoute(newEndpointHandler(&fakeStore{}), w, httptest.NewRequest(tc.method, tc.target, nil))
+			if tc.expectedStatusCode != w.Code {
+				t.Errorf("expected status code %v but got %v", tc.expectedStatusCode, w.Code)
+			}
+			if actual := w.Header().Get("Allow"); tc.expectedAllow != actual {
+				t.Errorf("expected Allow %q but got %q", tc.expectedAllow, actual)
+			}
+			if w.Code == http.StatusOK && w.Body.String() != tc.expected {
+				t.Errorf("expected %q but got %q", tc.expected, w.Body.String())
+			}
+			var body errorBody
+			if w.Code != http.StatusOK && (json.NewDecoder(w.Body).Decode(&body) != nil || body.Code == "") {
+				t.Errorf("expected an error body")
+			}
+		})
+	}
+}
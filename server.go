@@ -2,28 +2,35 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"time"
 )
 
+// serve serves HTTPS when server.TLSConfig is set (see newServerTLSConfig), and plain HTTP otherwise
 func serve(server *http.Server) {
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
-			fmt.Printf("server: %v\n", err)
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "") // certificates come from server.TLSConfig.GetCertificate
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil {
+			slog.Error("server: stopped serving", "error", err.Error())
 		}
 	}()
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
 
-	fmt.Printf("server: serving on %v\n", server.Addr)
+	slog.Info("server: serving", "addr", server.Addr, "tls", server.TLSConfig != nil)
 	<-stop
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	_ = server.Shutdown(ctx)
-	fmt.Printf("server: shutting down\n")
+	slog.Info("server: shutting down")
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// searcher is what /search needs from a backend
+type searcher interface {
+	// search returns up to 20 items matching searchTerm, most relevant by searchTerm and distance to loc first.
+	// ctx carries the request id (see logRequests) and the request's deadline, if any.
+	search(ctx context.Context, searchTerm string, loc location) (searchResult, error)
+}
+
+// searchResult is what a search found
+type searchResult struct {
+	items []item
+	// ids are the stable ids of items (see itemID), in the same order
+	ids []string
+	// scores are the relevance of items, in the same order: their text score multiplied by the decay of their
+	// distance from the search's location. searchCache re-ranks cached results by them; nil if unknown.
+	scores []float64
+	// timedOut is true when the backend ran out of time before searching everything, i.e. items are partial
+	timedOut bool
+}
+
+// itemStore is a search backend that can also read and write single items by their stable id (see itemID).
+// The HTTP layer only depends on this interface, so that it can be tested without a cluster and
+// alternative backends can be plugged in; db is the Elasticsearch implementation.
+type itemStore interface {
+	searcher
+	// get returns errItemNotFound if there's no item with that id
+	get(ctx context.Context, id string) (item, error)
+	// getVersion is get, along with the version of the item, for update
+	getVersion(ctx context.Context, id string) (item, itemVersion, error)
+	// getMany returns the items with the ids that exist, by id, in one round trip
+	getMany(ctx context.Context, ids []string) (map[string]item, error)
+	// create creates the item with that id, or returns errItemExists if there's one already
+	create(ctx context.Context, id string, it item) error
+	// put creates or replaces the item with that id, and reports whether it created it
+	put(ctx context.Context, id string, it item) (created bool, err error)
+	// update replaces the item with that id if it's still at version, or returns errItemChanged if it was written
+	// or deleted since
+	update(ctx context.Context, id string, it item, version itemVersion) error
+	// delete returns errItemNotFound if there's no item with that id
+	delete(ctx context.Context, id string) error
+}
+
+// itemVersion identifies a write of an item, like ES's _seq_no and _primary_term do, so that update only replaces
+// the item that was read
+type itemVersion struct {
+	seqNo, primaryTerm int64
+}
+
+var (
+	// errItemNotFound is returned by itemStores when an id doesn't exist
+	errItemNotFound = errors.New("item not found")
+	// errItemExists is returned by itemStores when creating an id that exists already
+	errItemExists = errors.New("item exists")
+	// errItemChanged is returned by itemStores when updating an item that was written or deleted since it was read
+	errItemChanged = errors.New("item changed")
+	// errStoreUnavailable wraps every backend-specific failure, so callers don't depend on backend error types
+	errStoreUnavailable = errors.New("item store unavailable")
+)
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// syncResult counts the bulk operations a sync sent to ES
+type syncResult struct {
+	Added   int `json:"added"`
+	Changed int `json:"changed"`
+	Removed int `json:"removed"`
+}
+
+func (r syncResult) String() string {
+	return fmt.Sprintf("added %v, changed %v, removed %v items", r.Added, r.Changed, r.Removed)
+}
+
+var listingIDRegexp = regexp.MustCompile(`-(\d+)$`)
+
+// itemID is the stable doc id of an item: the listing number at the end of its url (e.g. london/hire-camera-28584820).
+// Urls without a listing number fall back to a hash of the url, so the id still survives reloads.
+func itemID(it item) string {
+	if m := listingIDRegexp.FindStringSubmatch(it.URL); m != nil {
+		return m[1]
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(it.URL)))[0:16]
+}
+
+// itemIDs returns the stable doc id of each item, in order.
+// The dump has a few listings repeated under the same url; repetitions get a "-2", "-3"... suffix
+// so that they don't overwrite each other, which keeps ids stable as long as the dump keeps their relative order.
+func itemIDs(items []item) []string {
+	var (
+		ids  = make([]string, len(items))
+		seen = make(map[string]int, len(items))
+	)
+	for i, it := range items {
+		id := itemID(it)
+		seen[id]++
+		if seen[id] > 1 {
+			id += "-" + strconv.Itoa(seen[id])
+		}
+		ids[i] = id
+	}
+	return ids
+}
+
+// contentHash identifies an item's content, so that sync only sends changed items
+func contentHash(it item) string {
+	bs, _ := json.Marshal(it) // marshalling an item can't fail
+	return fmt.Sprintf("%x", sha256.Sum256(bs))
+}
+
+// mustSync upserts and deletes documents on db.index so that it matches items
+func (db db) mustSync(items []item) syncResult {
+	res, err := db.sync(context.Background(), items)
+	if err != nil {
+		fatal(err.Error())
+	}
+	return res
+}
+
+// sync compares items against db.index by stable id and content hash, and only sends the
+// bulk index/update/delete operations needed to make the index match them.
+// The index is created if it doesn't exist.
+func (db db) sync(ctx context.Context, items []item) (result syncResult, err error) {
+	ctx, span := startSpan(ctx, "db.sync", spanKindInternal)
+	defer func() { span.end(err) }()
+	span.setAttr("items", len(items))
+	exists, err := db.client.IndexExists(db.index).Do(ctx)
+	if err != nil {
+		return result, fmt.Errorf("sync: couldn't check if index exists: %v", err)
+	}
+	if !exists {
+		if err := db.createIndex(ctx); err != nil {
+			return result, fmt.Errorf("sync: %v", err)
+		}
+	}
+	current, err := db.contentHashes(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	var (
+		bulkRequest = db.client.Bulk()
+		ids         = itemIDs(items)
+		wanted      = make(map[string]bool, len(items))
+	)
+	for i, it := range items {
+		id := ids[i]
+		wanted[id] = true
+		hash, ok := current[id]
+		switch {
+		case !ok:
+			bulkRequest.Add(elastic.NewBulkIndexRequest().Index(db.index).Type(db.version.bulkType()).Id(id).Doc(it))
+			result.Added++
+		case hash != contentHash(it):
+			bulkRequest.Add(elastic.NewBulkUpdateRequest().Index(db.index).Type(db.version.bulkType()).Id(id).Doc(it))
+			result.Changed++
+		}
+	}
+	for id := range current {
+		if !wanted[id] {
+			bulkRequest.Add(elastic.NewBulkDeleteRequest().Index(db.index).Type(db.version.bulkType()).Id(id))
+			result.Removed++
+		}
+	}
+	if bulkRequest.NumberOfActions() == 0 {
+		return result, nil
+	}
+
+	var start, actions = time.Now(), bulkRequest.NumberOfActions()
+	span.setAttr("actions", actions)
+	bulkResponse, err := bulkRequest.Do(ctx)
+	observeBulk("sync", actions, start, bulkResponse, err)
+	if err != nil {
+		return result, fmt.Errorf("sync: couldn't do bulk request: %v", err)
+	}
+	if bulkResponse != nil && bulkResponse.Errors {
+		return result, fmt.Errorf("sync: bulk request had errors")
+	}
+	if _, err := db.client.Refresh(db.index).Do(ctx); err != nil {
+		return result, fmt.Errorf("sync: index refresh had error: %v", err)
+	}
+	return result, nil
+}
+
+// contentHashes returns the content hashes of every document on db.index by id
+func (db db) contentHashes(ctx context.Context) (map[string]string, error) {
+	docs, err := db.documents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("sync: %v", err)
+	}
+	hashes := make(map[string]string, len(docs))
+	for id, it := range docs {
+		hashes[id] = contentHash(it)
+	}
+	return hashes, nil
+}
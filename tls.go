@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloadCheckInterval is how often, at most, handshakes check whether certificate files changed on disk.
+// Certificates rotated by e.g. cert-manager are picked up without a restart, and without a stat on every handshake.
+var tlsReloadCheckInterval = 10 * time.Second
+
+// fileWatch tracks the modification times of files, to tell when they've changed
+type fileWatch struct {
+	files   []string
+	modTime time.Time
+	checked time.Time
+}
+
+// changed is true when any of the files was modified since the last call that returned true.
+// It only looks at the files once every tlsReloadCheckInterval.
+func (w *fileWatch) changed() bool {
+	if time.Since(w.checked) < tlsReloadCheckInterval {
+		return false
+	}
+	w.checked = time.Now()
+	var latest time.Time
+	for _, f := range w.files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return false // e.g. halfway through an atomic replace; try again later
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	if !latest.After(w.modTime) {
+		return false
+	}
+	w.modTime = latest
+	return true
+}
+
+// certReloader serves a certificate/key pair, reloading it when the files change.
+// A pair that fails to load (e.g. the cert was written but not the key yet) is logged, and the previous one kept.
+type certReloader struct {
+	certFile, keyFile string
+	mu                sync.Mutex
+	watch             fileWatch
+	cert              *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, watch: fileWatch{files: []string{certFile, keyFile}}}
+	r.watch.changed()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("newCertReloader: error loading %v: %v", certFile, err)
+	}
+	r.cert = &cert
+	return r, nil
+}
+
+func (r *certReloader) certificate() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.watch.changed() {
+		cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			slog.Error("certificate: keeping the previous certificate", "file", r.certFile, "error", err.Error())
+			return r.cert
+		}
+		slog.Info("certificate: reloaded", "file", r.certFile)
+		r.cert = &cert
+	}
+	return r.cert
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+// caReloader serves a pool of CA certificates from a PEM bundle, reloading it when the file changes
+type caReloader struct {
+	file  string
+	mu    sync.Mutex
+	watch fileWatch
+	pool  *x509.CertPool
+}
+
+func newCAReloader(file string) (*caReloader, error) {
+	r := &caReloader{file: file, watch: fileWatch{files: []string{file}}}
+	r.watch.changed()
+	pool, err := readCAFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r.pool = pool
+	return r, nil
+}
+
+func (r *caReloader) certPool() *x509.CertPool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.watch.changed() {
+		pool, err := readCAFile(r.file)
+		if err != nil {
+			slog.Error("certPool: keeping the previous CAs", "file", r.file, "error", err.Error())
+			return r.pool
+		}
+		slog.Info("certPool: reloaded", "file", r.file)
+		r.pool = pool
+	}
+	return r.pool
+}
+
+// verifyConnection verifies the server's certificate chain against the current CAs, which tls.Config.RootCAs
+// can't do since it's read once. host is the server's name when the connection doesn't say, i.e. for IP addresses.
+func (r *caReloader) verifyConnection(host string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("verifyConnection: no server certificate")
+		}
+		opts := x509.VerifyOptions{Roots: r.certPool(), DNSName: cs.ServerName, Intermediates: x509.NewCertPool()}
+		if opts.DNSName == "" {
+			opts.DNSName = host
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
+
+func readCAFile(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("readCAFile: error reading %v: %v", file, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("readCAFile: no PEM certificates in %v", file)
+	}
+	return pool, nil
+}
+
+// newESTLSConfig is the TLS config of the connection to ES: a private CA bundle, a client certificate, or
+// no verification at all for development. It's nil when none is set, i.e. the system CAs verify https urls.
+func newESTLSConfig(cfg config) (*tls.Config, error) {
+	if cfg.ESCAFile == "" && cfg.ESCertFile == "" && !cfg.ESInsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: cfg.ESInsecureSkipVerify}
+	if cfg.ESCAFile != "" {
+		ca, err := newCAReloader(cfg.ESCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("newESTLSConfig: %v", err)
+		}
+		u, err := url.Parse(cfg.ESURL)
+		if err != nil {
+			return nil, fmt.Errorf("newESTLSConfig: %v", err)
+		}
+		// Verification is done by verifyConnection instead, against the CAs on disk at the time
+		tlsConfig.InsecureSkipVerify, tlsConfig.VerifyConnection = true, ca.verifyConnection(u.Hostname())
+	}
+	if cfg.ESCertFile != "" {
+		cert, err := newCertReloader(cfg.ESCertFile, cfg.ESKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("newESTLSConfig: %v", err)
+		}
+		tlsConfig.GetClientCertificate = cert.getClientCertificate
+	}
+	return tlsConfig, nil
+}
+
+// newServerTLSConfig is the TLS config of the HTTP server, which requires client certificates signed by
+// tls-client-ca-file when set (i.e. mTLS). It's nil when the server should serve plain HTTP.
+func newServerTLSConfig(cfg config) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" {
+		return nil, nil
+	}
+	cert, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("newServerTLSConfig: %v", err)
+	}
+	// NextProtos are set here rather than by http.Server, which would only set them on its own copy, so that the
+	// per-handshake configs below, which are cloned from this one, negotiate HTTP/2 and HTTP/1.1 too
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: cert.getCertificate, NextProtos: []string{"h2", "http/1.1"}}
+	if cfg.TLSClientCAFile == "" {
+		return tlsConfig, nil
+	}
+	ca, err := newCAReloader(cfg.TLSClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("newServerTLSConfig: %v", err)
+	}
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	// tls.Config.ClientCAs is read once, so every handshake gets a copy of tlsConfig with the current client CAs
+	base := tlsConfig.Clone()
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		handshake := base.Clone()
+		handshake.ClientCAs = ca.certPool()
+		return handshake, nil
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA signs certificates for TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // PEM of cert
+}
+
+func newTestCA(dir, name string, t *testing.T) testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Errorf("couldn't create CA: %v", err)
+		t.FailNow()
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := testCA{cert: cert, key: key, file: filepath.Join(dir, name+".pem")}
+	writePEM(ca.file, "CERTIFICATE", der, t)
+	return ca
+}
+
+// issue writes a certificate for 127.0.0.1 named cn, and its key, to certFile and keyFile
+func (ca testCA) issue(cn, certFile, keyFile string, t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Errorf("couldn't issue certificate: %v", err)
+		t.FailNow()
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	writePEM(certFile, "CERTIFICATE", der, t)
+	writePEM(keyFile, "EC PRIVATE KEY", keyDER, t)
+}
+
+func writePEM(file, typ string, der []byte, t *testing.T) {
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Errorf("couldn't write %v: %v", file, err)
+		t.FailNow()
+	}
+}
+
+// touch makes files look modified later than any previous write, so that reloads don't depend on mtime resolution
+func touch(t *testing.T, files ...string) {
+	later := time.Now().Add(time.Minute)
+	for _, f := range files {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Errorf("couldn't touch %v: %v", f, err)
+			t.FailNow()
+		}
+	}
+}
+
+// Server TLS test serves mTLS, and expects only clients with a certificate from the client CA to get through,
+// to negotiate HTTP/2 or HTTP/1.1, and rotated server certificates to be served without a restart.
+func TestServerTLS(t *testing.T) {
+	defer func(interval time.Duration) { tlsReloadCheckInterval = interval }(tlsReloadCheckInterval)
+	tlsReloadCheckInterval = 0
+
+	var (
+		dir        = t.TempDir()
+		serverCA   = newTestCA(dir, "server-ca", t)
+		clientCA   = newTestCA(dir, "client-ca", t)
+		otherCA    = newTestCA(dir, "other-ca", t)
+		serverCert = filepath.Join(dir, "server.pem")
+		serverKey  = filepath.Join(dir, "server-key.pem")
+	)
+	serverCA.issue("server-1", serverCert, serverKey, t)
+	clientCA.issue("client", filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"), t)
+	otherCA.issue("intruder", filepath.Join(dir, "intruder.pem"), filepath.Join(dir, "intruder-key.pem"), t)
+
+	tlsConfig, err := newServerTLSConfig(config{TLSCertFile: serverCert, TLSKeyFile: serverKey, TLSClientCAFile: clientCA.file})
+	if err != nil {
+		t.Errorf("couldn't make TLS config: %v", err)
+		t.FailNow()
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	request := func(clientCert string) (string, error) {
+		roots, _ := readCAFile(serverCA.file)
+		clientTLS := &tls.Config{RootCAs: roots}
+		if clientCert != "" {
+			cert, err := tls.LoadX509KeyPair(filepath.Join(dir, clientCert+".pem"), filepath.Join(dir, clientCert+"-key.pem"))
+			if err != nil {
+				return "", err
+			}
+			clientTLS.Certificates = []tls.Certificate{cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+		res, err := client.Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		res.Body.Close()
+		return res.TLS.PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	if _, err := request(""); err == nil {
+		t.Errorf("expected clients without a certificate to be rejected")
+	}
+	if _, err := request("intruder"); err == nil {
+		t.Errorf("expected clients with a certificate from another CA to be rejected")
+	}
+	if cn, err := request("client"); err != nil || cn != "server-1" {
+		t.Errorf("expected server-1 to serve the client but got %v, %v", cn, err)
+	}
+	for _, proto := range []string{"h2", "http/1.1"} {
+		roots, _ := readCAFile(serverCA.file)
+		cert, _ := tls.LoadX509KeyPair(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}, NextProtos: []string{proto}})
+		if err != nil {
+			t.Errorf("expected to negotiate %v but got %v", proto, err)
+			continue
+		}
+		if actual := conn.ConnectionState().NegotiatedProtocol; actual != proto {
+			t.Errorf("expected to negotiate %v but got %q", proto, actual)
+		}
+		conn.Close()
+	}
+
+	serverCA.issue("server-2", serverCert, serverKey, t)
+	touch(t, serverCert, serverKey)
+	if cn, err := request("client"); err != nil || cn != "server-2" {
+		t.Errorf("expected the rotated server-2 certificate but got %v, %v", cn, err)
+	}
+}
+
+// ES TLS test connects to an ES behind a private CA, with a client certificate, and expects a CA rotation to be picked up.
+func TestESTLS(t *testing.T) {
+	defer func(interval time.Duration) { tlsReloadCheckInterval = interval }(tlsReloadCheckInterval)
+	tlsReloadCheckInterval = 0
+
+	var (
+		dir      = t.TempDir()
+		esCA     = newTestCA(dir, "es-ca", t)
+		clientCA = newTestCA(dir, "client-ca", t)
+		caFile   = filepath.Join(dir, "ca-bundle.pem")
+		es       = newFakeES(fakeES6, t)
+	)
+	es.Close()
+	esCA.issue("es", filepath.Join(dir, "es.pem"), filepath.Join(dir, "es-key.pem"), t)
+	clientCA.issue("fl", filepath.Join(dir, "fl.pem"), filepath.Join(dir, "fl-key.pem"), t)
+	esCert, _ := tls.LoadX509KeyPair(filepath.Join(dir, "es.pem"), filepath.Join(dir, "es-key.pem"))
+	clientCAs, _ := readCAFile(clientCA.file)
+	es.Server = httptest.NewUnstartedServer(es)
+	es.TLS = &tls.Config{Certificates: []tls.Certificate{esCert}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	es.StartTLS()
+
+	// A bundle without the ES CA yet
+	otherCA := newTestCA(dir, "other-ca", t)
+	bundle, _ := os.ReadFile(otherCA.file)
+	if err := os.WriteFile(caFile, bundle, 0600); err != nil {
+		t.Errorf("couldn't write CA bundle: %v", err)
+		t.FailNow()
+	}
+	tlsConfig, err := newESTLSConfig(config{ESURL: es.URL, ESCAFile: caFile, ESCertFile: filepath.Join(dir, "fl.pem"), ESKeyFile: filepath.Join(dir, "fl-key.pem")})
+	if err != nil {
+		t.Errorf("couldn't make TLS config: %v", err)
+		t.FailNow()
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	if _, err := client.Get(es.URL); err == nil {
+		t.Errorf("expected ES's certificate to be rejected before its CA is in the bundle")
+	}
+
+	esBundle, _ := os.ReadFile(esCA.file)
+	if err := os.WriteFile(caFile, append(bundle, esBundle...), 0600); err != nil {
+		t.Errorf("couldn't write CA bundle: %v", err)
+		t.FailNow()
+	}
+	touch(t, caFile)
+	wrongHost, _ := newESTLSConfig(config{ESURL: "https://es.internal:9200", ESCAFile: caFile})
+	if _, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: wrongHost}}).Get(es.URL); err == nil {
+		t.Errorf("expected ES's certificate to be rejected for another host")
+	}
+	db, err := newDB(es.URL, "elastic", "changeme", "items", tlsConfig, 5*time.Second, defaultConfig.esResilience())
+	if err != nil {
+		t.Errorf("expected to connect once the ES CA is in the bundle but got %v", err)
+		t.FailNow()
+	}
+	db.client.Stop()
+}
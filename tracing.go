@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing follows W3C Trace Context (traceparent/tracestate headers) and exports spans in the OTLP/JSON shape, so
+// that they can be sent to any OpenTelemetry collector. The OpenTelemetry SDK isn't a dependency: spans, propagation
+// and the exporters below are all this service needs.
+
+type spanKind int
+
+// OTLP span kinds
+const (
+	spanKindInternal spanKind = 1
+	spanKindServer   spanKind = 2
+	spanKindClient   spanKind = 3
+)
+
+// span is a timed operation of a trace. Spans are only exported when sampled, but they always propagate.
+type span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	traceState string
+	sampled    bool
+	name       string
+	kind       spanKind
+	start      time.Time
+	mu         sync.Mutex
+	attrs      map[string]interface{}
+	err        error
+}
+
+type spanKey struct{}
+
+// tracer exports the spans that end. A nil exporter (i.e. tracing is off) still propagates trace context.
+type tracer struct {
+	exporter spanExporter
+}
+
+// spanExporter sends ended spans somewhere
+type spanExporter interface {
+	export(s *span)
+	close() error
+}
+
+var defaultTracer = &tracer{}
+
+// traceparentRegexp is version 00 of the traceparent header: 00-<trace id>-<parent id>-<flags>
+var traceparentRegexp = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// startSpan starts a span, as a child of the span of ctx if there's one, and returns a context carrying it.
+// End it with span.end.
+func startSpan(ctx context.Context, name string, kind spanKind) (context.Context, *span) {
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]interface{})}
+	if parent := spanFrom(ctx); parent != nil {
+		s.traceID, s.parentID, s.sampled, s.traceState = parent.traceID, parent.spanID, parent.sampled, parent.traceState
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+		s.sampled = defaultTracer.exporter != nil
+	}
+	_, _ = rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// spanFrom returns the span of ctx, or nil
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// withRemoteParent returns a context whose spans are children of the span of a traceparent header.
+// Invalid headers are ignored, i.e. spans start a new trace.
+func withRemoteParent(ctx context.Context, traceparent, tracestate string) context.Context {
+	m := traceparentRegexp.FindStringSubmatch(traceparent)
+	if m == nil || m[1] == "00000000000000000000000000000000" || m[2] == "0000000000000000" {
+		return ctx
+	}
+	parent := &span{traceState: tracestate}
+	hex.Decode(parent.traceID[:], []byte(m[1]))
+	hex.Decode(parent.spanID[:], []byte(m[2]))
+	flags, _ := strconv.ParseUint(m[3], 16, 8)
+	parent.sampled = flags&1 == 1 && defaultTracer.exporter != nil
+	return context.WithValue(ctx, spanKey{}, parent)
+}
+
+// traceparent is the header that makes requests children of s
+func (s *span) traceparent() string {
+	var flags = "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%v", s.traceID, s.spanID, flags)
+}
+
+// setRoute names a server span after the route pattern that matched its request, e.g. GET /items/{id}, as the
+// OpenTelemetry HTTP conventions do, so that ids in paths don't make span names unbounded
+func (s *span) setRoute(method, pattern string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = method + " " + pattern
+	s.attrs["http.route"] = pattern
+}
+
+func (s *span) setAttr(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// end ends the span, as failed if err isn't nil, and exports it if sampled
+func (s *span) end(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	if s.sampled && defaultTracer.exporter != nil {
+		defaultTracer.exporter.export(s)
+	}
+}
+
+// otlpSpan is the OTLP/JSON encoding of a span
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              spanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"` // 2 is error
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (s *span) otlp(end time.Time) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		TraceState:        s.traceState,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	keys := make([]string, 0, len(s.attrs))
+	for k := range s.attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var value = make(map[string]interface{})
+		switch v := s.attrs[k].(type) {
+		case int:
+			value["intValue"] = strconv.Itoa(v)
+		case float64:
+			value["doubleValue"] = v
+		case bool:
+			value["boolValue"] = v
+		default:
+			value["stringValue"] = fmt.Sprint(v)
+		}
+		o.Attributes = append(o.Attributes, otlpAttribute{Key: k, Value: value})
+	}
+	if s.err != nil {
+		o.Status.Code, o.Status.Message = 2, s.err.Error()
+	}
+	return o
+}
+
+// writerExporter writes a JSON line per span, e.g. to stdout or a file
+type writerExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (e *writerExporter) export(s *span) {
+	line, _ := json.Marshal(s.otlp(time.Now()))
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, _ = e.w.Write(append(line, '\n'))
+}
+
+func (e *writerExporter) close() error {
+	if c, ok := e.w.(io.Closer); ok && e.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// otlpExporter posts batches of spans to an OTLP/HTTP collector (e.g. http://collector:4318/v1/traces) in the
+// background. Spans are dropped rather than slowing down requests when the collector can't keep up.
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+	spans    chan otlpSpan
+	done     chan struct{}
+}
+
+const (
+	otlpBatchSize     = 512
+	otlpFlushInterval = 2 * time.Second
+)
+
+func newOTLPExporter(endpoint string) *otlpExporter {
+	e := &otlpExporter{endpoint: endpoint, client: &http.Client{Timeout: 10 * time.Second},
+		spans: make(chan otlpSpan, 4*otlpBatchSize), done: make(chan struct{})}
+	go e.run()
+	return e
+}
+
+func (e *otlpExporter) export(s *span) {
+	select {
+	case e.spans <- s.otlp(time.Now()):
+	default:
+		slog.Warn("otlpExporter: dropping span, the collector isn't keeping up", "span", s.name)
+	}
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.done)
+	var (
+		batch  []otlpSpan
+		ticker = time.NewTicker(otlpFlushInterval)
+	)
+	defer ticker.Stop()
+	for {
+		select {
+		case s, ok := <-e.spans:
+			if !ok {
+				e.post(batch)
+				return
+			}
+			if batch = append(batch, s); len(batch) >= otlpBatchSize {
+				e.post(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.post(batch)
+			batch = nil
+		}
+	}
+}
+
+func (e *otlpExporter) post(batch []otlpSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource":   map[string]interface{}{"attributes": []otlpAttribute{{Key: "service.name", Value: map[string]interface{}{"stringValue": "fl"}}}},
+			"scopeSpans": []interface{}{map[string]interface{}{"scope": map[string]string{"name": "fl"}, "spans": batch}},
+		}},
+	})
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Error("otlpExporter: couldn't export spans", "spans", len(batch), "error", err.Error())
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		slog.Error("otlpExporter: collector rejected spans", "spans", len(batch), "status", res.StatusCode)
+	}
+}
+
+// close flushes the spans exported so far
+func (e *otlpExporter) close() error {
+	close(e.spans)
+	<-e.done
+	return nil
+}
+
+// newSpanExporter is the exporter of cfg.TraceExporter: none (nil), stdout, file (cfg.TraceFile) or otlp
+// (cfg.TraceOTLPEndpoint)
+func newSpanExporter(cfg config) (spanExporter, error) {
+	switch cfg.TraceExporter {
+	case "stdout":
+		return &writerExporter{w: os.Stdout}, nil
+	case "file":
+		fh, err := os.OpenFile(cfg.TraceFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("newSpanExporter: error opening trace file: %v", err)
+		}
+		return &writerExporter{w: fh}, nil
+	case "otlp":
+		return newOTLPExporter(cfg.TraceOTLPEndpoint), nil
+	}
+	return nil, nil
+}
+
+// traceRequests starts a server span per request, as a child of the request's traceparent header if it has one.
+// It's named after the method until the router names it after the route that matched (see span.setRoute); the path
+// is only its http.target.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := withRemoteParent(r.Context(), r.Header.Get("traceparent"), r.Header.Get("tracestate"))
+		ctx, span := startSpan(ctx, r.Method, spanKindServer)
+		span.setAttr("http.method", r.Method)
+		span.setAttr("http.target", r.URL.Path)
+		if id := requestIDFrom(ctx); id != "" {
+			span.setAttr("request_id", id)
+		}
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		span.setAttr("http.status_code", rec.code)
+		var err error
+		if rec.code >= 500 {
+			err = fmt.Errorf("%v %v", rec.code, http.StatusText(rec.code))
+		}
+		span.end(err)
+	})
+}
+
+// tracingTransport makes every ES request a client span, named after its path without document ids (see
+// esPathTemplate), and propagates it to ES as traceparent
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := startSpan(req.Context(), "elasticsearch "+req.Method+" "+esPathTemplate(req.URL.Path), spanKindClient)
+	span.setAttr("http.method", req.Method)
+	span.setAttr("http.url", req.URL.Redacted())
+	span.setAttr("db.system", "elasticsearch")
+	req = req.Clone(ctx)
+	req.Header.Set("traceparent", span.traceparent())
+	if span.traceState != "" {
+		req.Header.Set("tracestate", span.traceState)
+	}
+	res, err := t.next.RoundTrip(req)
+	if err == nil {
+		span.setAttr("http.status_code", res.StatusCode)
+		if res.StatusCode >= 500 {
+			err = fmt.Errorf("%v %v", res.StatusCode, http.StatusText(res.StatusCode))
+		}
+		span.end(err)
+		return res, nil
+	}
+	span.end(err)
+	return res, err
+}
+
+// esPathTemplate is an ES path with its document ids replaced by {id}: ES paths are an index or an API (e.g. _bulk),
+// then a type or an API (e.g. _doc or _search), then a document id, and maybe an API of the document again
+func esPathTemplate(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 2; i < len(segments); i++ {
+		if !strings.HasPrefix(segments[i], "_") {
+			segments[i] = "{id}"
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
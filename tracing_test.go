@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Tracing test searches with and without an incoming traceparent, and expects the exported spans to form one trace
+// (server span, handler, db, ES client span), continued from the incoming one, and propagated to ES.
+func TestTracing(t *testing.T) {
+	const incomingTraceID, incomingSpanID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	tests := []struct {
+		name             string
+		traceparent      string
+		expectedSpans    []string
+		expectedContinue bool // whether the trace continues the incoming one
+	}{
+		{
+			name:             "sampled parent",
+			traceparent:      "00-" + incomingTraceID + "-" + incomingSpanID + "-01",
+			expectedSpans:    []string{"elasticsearch POST /items/_search", "db.search", "endpointHandler.search", "GET /search"},
+			expectedContinue: true,
+		},
+		{
+			name:             "unsampled parent",
+			traceparent:      "00-" + incomingTraceID + "-" + incomingSpanID + "-00",
+			expectedContinue: true,
+		},
+		{
+			name:          "no parent",
+			expectedSpans: []string{"elasticsearch POST /items/_search", "db.search", "endpointHandler.search", "GET /search"},
+		},
+		{
+			name:          "invalid parent starts a new trace",
+			traceparent:   "00-" + strings.Repeat("0", 32) + "-" + incomingSpanID + "-01",
+			expectedSpans: []string{"elasticsearch POST /items/_search", "db.search", "endpointHandler.search", "GET /search"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				es    = newFakeES(fakeES6, t)
+				db    = es.newDB("items", t)
+				w     = httptest.NewRecorder()
+				req   = httptest.NewRequest("GET", "/search?searchTerm=camera&lat=51&lng=0", nil)
+				spans bytes.Buffer
+			)
+			loadItemsIntoTestIndex(`"camera",51,0,london/camera,[]`, false, db, t)
+			defaultTracer.exporter = &writerExporter{w: &spans}
+			defer func() { defaultTracer.exporter = nil }()
+			if tc.traceparent != "" {
+				req.Header.Set("traceparent", tc.traceparent)
+				req.Header.Set("tracestate", "vendor=value")
+			}
+			traceRequests(newEndpointHandler(db)).ServeHTTP(w, req)
+
+			var exported []otlpSpan
+			for _, line := range strings.Split(strings.TrimSpace(spans.String()), "\n") {
+				if line == "" {
+					continue
+				}
+				var s otlpSpan
+				if err := json.Unmarshal([]byte(line), &s); err != nil {
+					t.Errorf("expected a JSON span but got %v", line)
+					t.FailNow()
+				}
+				exported = append(exported, s)
+			}
+			var names []string
+			for _, s := range exported {
+				names = append(names, s.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tc.expectedSpans, ",") {
+				t.Errorf("expected spans %v but got %v", tc.expectedSpans, names)
+				t.FailNow()
+			}
+
+			searches := es.received("POST", "/items/_search")
+			if len(searches) != 1 {
+				t.Errorf("expected 1 ES search but got %v", len(searches))
+				t.FailNow()
+			}
+			m := traceparentRegexp.FindStringSubmatch(searches[0].Header.Get("traceparent"))
+			if m == nil {
+				t.Errorf("expected a traceparent on the ES search but got %q", searches[0].Header.Get("traceparent"))
+				t.FailNow()
+			}
+			if tc.expectedContinue != (m[1] == incomingTraceID) {
+				t.Errorf("expected the ES search's trace id %v to continue the incoming one: %v", m[1], tc.expectedContinue)
+			}
+			if len(exported) == 0 {
+				if m[3] != "00" {
+					t.Errorf("expected an unsampled traceparent on the ES search but got %v", m[0])
+				}
+				return
+			}
+			for i, s := range exported {
+				if s.TraceID != m[1] {
+					t.Errorf("expected span %v in trace %v but got %v", s.Name, m[1], s.TraceID)
+				}
+				if i > 0 && exported[i-1].ParentSpanID != s.SpanID { // children end first
+					t.Errorf("expected span %v to be the parent of %v", s.Name, exported[i-1].Name)
+				}
+			}
+			if exported[0].SpanID != m[2] {
+				t.Errorf("expected the ES search's parent to be span %v but got %v", exported[0].SpanID, m[2])
+			}
+			server := exported[len(exported)-1]
+			if tc.expectedContinue && (server.ParentSpanID != incomingSpanID || server.TraceState != "vendor=value") {
+				t.Errorf("expected the server span to continue the incoming span, but got %+v", server)
+			}
+			if !tc.expectedContinue && server.ParentSpanID != "" {
+				t.Errorf("expected the server span to be a root span, but got %+v", server)
+			}
+		})
+	}
+}
+
+// Span names test expects server spans to be named after the route that matched rather than the path, with the path
+// as http.target, and ES client spans after their path without document ids, so that span names stay bounded.
+func TestSpanNames(t *testing.T) {
+	tests := []struct {
+		target         string
+		expectedServer string
+		expectedRoute  string
+		expectedES     string // client span, if any
+	}{
+		{target: "/search?searchTerm=camera&lat=51&lng=0", expectedServer: "GET /search", expectedRoute: "/search", expectedES: "elasticsearch POST /items/_search"},
+		{target: "/items/28584820", expectedServer: "GET /items/{id}", expectedRoute: "/items/{id}", expectedES: "elasticsearch GET /items/item/{id}"},
+		{target: "/items/camera-1", expectedServer: "GET /items/{id}", expectedRoute: "/items/{id}", expectedES: "elasticsearch GET /items/item/{id}"},
+		{target: "/no/such/path", expectedServer: "GET"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.target, func(t *testing.T) {
+			var (
+				es    = newFakeES(fakeES6, t)
+				db    = es.newDB("items", t)
+				spans bytes.Buffer
+			)
+			loadItemsIntoTestIndex(`"camera",51,0,london/camera,[]`, false, db, t)
+			defaultTracer.exporter = &writerExporter{w: &spans}
+			defer func() { defaultTracer.exporter = nil }()
+			traceRequests(newEndpointHandler(db)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tc.target, nil))
+
+			var server, client *otlpSpan
+			for _, line := range strings.Split(strings.TrimSpace(spans.String()), "\n") {
+				var s otlpSpan
+				if err := json.Unmarshal([]byte(line), &s); err != nil {
+					t.Errorf("expected a JSON span but got %v", line)
+					t.FailNow()
+				}
+				switch s.Kind {
+				case spanKindServer:
+					server = &s
+				case spanKindClient:
+					client = &s
+				}
+			}
+			if server == nil || server.Name != tc.expectedServer {
+				t.Errorf("expected the server span %q but got %+v", tc.expectedServer, server)
+				t.FailNow()
+			}
+			attrs := make(map[string]string)
+			for _, a := range server.Attributes {
+				attrs[a.Key] = fmt.Sprint(a.Value["stringValue"])
+			}
+			if path := strings.Split(tc.target, "?")[0]; attrs["http.target"] != path {
+				t.Errorf("expected http.target %q but got %q", path, attrs["http.target"])
+			}
+			if attrs["http.route"] != tc.expectedRoute {
+				t.Errorf("expected http.route %q but got %q", tc.expectedRoute, attrs["http.route"])
+			}
+			if client == nil && tc.expectedES != "" || client != nil && client.Name != tc.expectedES {
+				t.Errorf("expected the ES span %q but got %+v", tc.expectedES, client)
+			}
+		})
+	}
+}
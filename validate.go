@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ruleAction is what the validator does with an item that breaks a rule
+type ruleAction string
+
+const (
+	actionReject ruleAction = "reject" // drop the item
+	actionWarn   ruleAction = "warn"   // log and index the item as is
+	actionFix    ruleAction = "fix"    // fix the item if the rule knows how to, otherwise drop it
+)
+
+// validationConfig sets the action for each rule, plus the rules' parameters.
+// It can be loaded from a JSON file with the same keys; missing keys keep their defaults.
+type validationConfig struct {
+	Coordinates     ruleAction `json:"coordinates"`
+	ServiceArea     ruleAction `json:"service_area"`
+	Name            ruleAction `json:"name"`
+	URLSlug         ruleAction `json:"url_slug"`
+	ImageExtensions ruleAction `json:"image_extensions"`
+
+	ServiceAreaPolygon []location `json:"service_area_polygon"`
+	AllowedExtensions  []string   `json:"allowed_extensions"`
+}
+
+// defaultValidationConfig accepts the whole current dump: every item is within the UK & Ireland
+var defaultValidationConfig = validationConfig{
+	Coordinates:     actionFix,
+	ServiceArea:     actionFix,
+	Name:            actionReject,
+	URLSlug:         actionWarn,
+	ImageExtensions: actionFix,
+
+	ServiceAreaPolygon: []location{{Lat: 49.8, Lon: -10.7}, {Lat: 49.8, Lon: 2.1}, {Lat: 61, Lon: 2.1}, {Lat: 61, Lon: -10.7}},
+	AllowedExtensions:  []string{"jpg", "jpeg", "png", "gif", "heic"},
+}
+
+func mustReadValidationConfigFromFile(path string) validationConfig {
+	cfg, err := readValidationConfigFromFile(path)
+	if err != nil {
+		fatal(err.Error())
+	}
+	return cfg
+}
+
+func readValidationConfigFromFile(path string) (validationConfig, error) {
+	cfg := defaultValidationConfig
+	fh, err := os.Open(path)
+	if err != nil {
+		return cfg, fmt.Errorf("readValidationConfigFromFile: error opening file: %v", err)
+	}
+	defer fh.Close()
+	if err := json.NewDecoder(fh).Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("readValidationConfigFromFile: error parsing %v: %v", path, err)
+	}
+	for _, a := range []ruleAction{cfg.Coordinates, cfg.ServiceArea, cfg.Name, cfg.URLSlug, cfg.ImageExtensions} {
+		if a != actionReject && a != actionWarn && a != actionFix {
+			return cfg, fmt.Errorf("readValidationConfigFromFile: unknown action %q; use reject, warn or fix", a)
+		}
+	}
+	if len(cfg.ServiceAreaPolygon) < 3 {
+		return cfg, fmt.Errorf("readValidationConfigFromFile: service_area_polygon needs at least 3 points")
+	}
+	return cfg, nil
+}
+
+// validationIssue is a rule broken by an item, and what was done about it
+type validationIssue struct {
+	Rule    string     `json:"rule"`
+	Item    item       `json:"item"`
+	Problem string     `json:"problem"`
+	Action  ruleAction `json:"action"`
+	Fixed   bool       `json:"fixed"`
+}
+
+func (i validationIssue) String() string {
+	var outcome = "kept"
+	switch {
+	case i.Fixed:
+		outcome = "fixed"
+	case i.Action != actionWarn:
+		outcome = "rejected"
+	}
+	return fmt.Sprintf("%v: %v (%v) %v", i.Rule, i.Item.URL, i.Problem, outcome)
+}
+
+// validationRule checks an item, returning a description of the problem if it breaks the rule.
+// fix is optional; it returns the fixed item, or false if the item can't be fixed.
+type validationRule struct {
+	name   string
+	action ruleAction
+	check  func(it item) (problem string)
+	fix    func(it item) (item, bool)
+}
+
+type validator struct {
+	rules []validationRule
+}
+
+var (
+	urlSlugRegexp    = regexp.MustCompile(`^[a-z0-9-]+/[a-z0-9-]+$`)
+	whitespaceRegexp = regexp.MustCompile(`\s+`)
+)
+
+func newValidator(cfg validationConfig) validator {
+	var (
+		allowedExt = make(map[string]bool, len(cfg.AllowedExtensions))
+		area       = cfg.ServiceAreaPolygon
+	)
+	for _, ext := range cfg.AllowedExtensions {
+		allowedExt[strings.ToLower(strings.TrimPrefix(ext, "."))] = true
+	}
+	hasAllowedExt := func(img string) bool {
+		return allowedExt[strings.ToLower(strings.TrimPrefix(path.Ext(img), "."))]
+	}
+	swapped := func(it item) item {
+		it.Location = location{Lat: it.Location.Lon, Lon: it.Location.Lat}
+		return it
+	}
+	return validator{rules: []validationRule{
+		{
+			name:   "coordinates",
+			action: cfg.Coordinates,
+			check: func(it item) string {
+				return coordinatesProblem(it.Location)
+			},
+			// Swapped coordinates are the usual culprit, as lat/lon and lon/lat orders are both common
+			fix: func(it item) (item, bool) {
+				it = swapped(it)
+				return it, coordinatesProblem(it.Location) == "" && inPolygon(it.Location, area)
+			},
+		},
+		{
+			name:   "service_area",
+			action: cfg.ServiceArea,
+			check: func(it item) string {
+				if !inPolygon(it.Location, area) {
+					return fmt.Sprintf("%v,%v is outside of the service area", it.Location.Lat, it.Location.Lon)
+				}
+				return ""
+			},
+			fix: func(it item) (item, bool) {
+				it = swapped(it)
+				return it, inPolygon(it.Location, area)
+			},
+		},
+		{
+			name:   "name",
+			action: cfg.Name,
+			check: func(it item) string {
+				if strings.TrimSpace(it.Name) == "" {
+					return "empty name"
+				}
+				return ""
+			},
+		},
+		{
+			name:   "url_slug",
+			action: cfg.URLSlug,
+			check: func(it item) string {
+				if !urlSlugRegexp.MatchString(it.URL) {
+					return fmt.Sprintf("url %q is not a city/listing slug", it.URL)
+				}
+				return ""
+			},
+			fix: func(it item) (item, bool) {
+				it.URL = whitespaceRegexp.ReplaceAllString(strings.ToLower(strings.TrimSpace(it.URL)), "-")
+				return it, urlSlugRegexp.MatchString(it.URL)
+			},
+		},
+		{
+			name:   "image_extensions",
+			action: cfg.ImageExtensions,
+			check: func(it item) string {
+				for _, img := range it.ImgURLs {
+					if !hasAllowedExt(img) {
+						return fmt.Sprintf("image %q has an unexpected extension", img)
+					}
+				}
+				return ""
+			},
+			// Drops the offending images but keeps the rest of the item
+			fix: func(it item) (item, bool) {
+				imgURLs := make([]string, 0, len(it.ImgURLs))
+				for _, img := range it.ImgURLs {
+					if hasAllowedExt(img) {
+						imgURLs = append(imgURLs, img)
+					}
+				}
+				it.ImgURLs = imgURLs
+				return it, true
+			},
+		},
+	}}
+}
+
+// validateItem runs every rule on it in order, and returns the item to index (possibly fixed),
+// whether it should be indexed at all, and the rules it broke.
+func (v validator) validateItem(it item) (item, bool, []validationIssue) {
+	var issues []validationIssue
+	for _, rule := range v.rules {
+		problem := rule.check(it)
+		if problem == "" {
+			continue
+		}
+		issue := validationIssue{Rule: rule.name, Item: it, Problem: problem, Action: rule.action}
+		switch rule.action {
+		case actionWarn:
+			issues = append(issues, issue)
+			continue
+		case actionFix:
+			if rule.fix != nil {
+				if fixed, ok := rule.fix(it); ok {
+					it, issue.Fixed = fixed, true
+					issues = append(issues, issue)
+					continue
+				}
+			}
+		}
+		return it, false, append(issues, issue)
+	}
+	return it, true, issues
+}
+
+// validate runs validateItem on all items, logging every issue, and returns the items to index
+func (v validator) validate(items []item) ([]item, []validationIssue) {
+	var (
+		valid  = make([]item, 0, len(items))
+		issues []validationIssue
+	)
+	for _, it := range items {
+		it, ok, itemIssues := v.validateItem(it)
+		for _, issue := range itemIssues {
+			slog.Warn("validate: "+issue.String(), "rule", issue.Rule, "url", issue.Item.URL, "action", string(issue.Action), "fixed", issue.Fixed)
+		}
+		issues = append(issues, itemIssues...)
+		if ok {
+			valid = append(valid, it)
+		}
+	}
+	return valid, issues
+}
+
+func coordinatesProblem(loc location) string {
+	switch {
+	case math.IsNaN(loc.Lat) || math.IsNaN(loc.Lon) || math.IsInf(loc.Lat, 0) || math.IsInf(loc.Lon, 0):
+		return "coordinates are not finite"
+	case loc.Lat < -90 || loc.Lat > 90:
+		return fmt.Sprintf("latitude %v is out of range", loc.Lat)
+	case loc.Lon < -180 || loc.Lon > 180:
+		return fmt.Sprintf("longitude %v is out of range", loc.Lon)
+	case loc.Lat == 0 && loc.Lon == 0:
+		return "coordinates are 0,0"
+	}
+	return ""
+}
+
+// inPolygon is a ray casting point-in-polygon test; fine for service areas that don't cross the antimeridian
+func inPolygon(loc location, polygon []location) bool {
+	var inside bool
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > loc.Lat) != (b.Lat > loc.Lat) &&
+			loc.Lon < (b.Lon-a.Lon)*(loc.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestValidateItem(t *testing.T) {
+	var (
+		strict = defaultValidationConfig
+		ts     = []struct {
+			name     string
+			cfg      validationConfig
+			item     item
+			expected item
+			ok       bool
+			rules    []string
+		}{
+			{
+				name:     "valid item is indexed as is",
+				cfg:      defaultValidationConfig,
+				item:     item{"camera", location{51, 0}, "london/camera", []string{"camera.jpg"}},
+				expected: item{"camera", location{51, 0}, "london/camera", []string{"camera.jpg"}},
+				ok:       true,
+			},
+			{
+				name:     "swapped coordinates are fixed",
+				cfg:      defaultValidationConfig,
+				item:     item{"camera", location{-0.1, 51.5}, "london/camera", []string{}},
+				expected: item{"camera", location{51.5, -0.1}, "london/camera", []string{}},
+				ok:       true,
+				rules:    []string{"service_area"},
+			},
+			{
+				name:  "0,0 is rejected",
+				cfg:   defaultValidationConfig,
+				item:  item{"camera", location{0, 0}, "london/camera", []string{}},
+				ok:    false,
+				rules: []string{"coordinates"},
+			},
+			{
+				name:  "out of range latitude is rejected",
+				cfg:   defaultValidationConfig,
+				item:  item{"camera", location{500, 0}, "london/camera", []string{}},
+				ok:    false,
+				rules: []string{"coordinates"},
+			},
+			{
+				name:  "outside of service area is rejected",
+				cfg:   defaultValidationConfig,
+				item:  item{"camera", location{34, -118.2}, "los-angeles/camera", []string{}},
+				ok:    false,
+				rules: []string{"service_area"},
+			},
+			{
+				name:  "empty name is rejected",
+				cfg:   defaultValidationConfig,
+				item:  item{"  ", location{51, 0}, "london/camera", []string{}},
+				ok:    false,
+				rules: []string{"name"},
+			},
+			{
+				name:     "bad url slug only warns by default",
+				cfg:      defaultValidationConfig,
+				item:     item{"camera", location{51, 0}, "London/Camera Hire", []string{}},
+				expected: item{"camera", location{51, 0}, "London/Camera Hire", []string{}},
+				ok:       true,
+				rules:    []string{"url_slug"},
+			},
+			{
+				name:     "bad url slug can be fixed",
+				cfg:      func() validationConfig { strict.URLSlug = actionFix; return strict }(),
+				item:     item{"camera", location{51, 0}, "London/Camera Hire", []string{}},
+				expected: item{"camera", location{51, 0}, "london/camera-hire", []string{}},
+				ok:       true,
+				rules:    []string{"url_slug"},
+			},
+			{
+				name:     "images with unexpected extensions are dropped",
+				cfg:      defaultValidationConfig,
+				item:     item{"camera", location{51, 0}, "london/camera", []string{"camera.JPG", "camera.exe"}},
+				expected: item{"camera", location{51, 0}, "london/camera", []string{"camera.JPG"}},
+				ok:       true,
+				rules:    []string{"image_extensions"},
+			},
+		}
+	)
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, ok, issues := newValidator(tc.cfg).validateItem(tc.item)
+			if tc.ok != ok {
+				t.Errorf("expected ok to be %v but got %v", tc.ok, ok)
+			}
+			if ok && !reflect.DeepEqual(tc.expected, actual) {
+				t.Errorf("expected %v but got %v", tc.expected, actual)
+			}
+			var rules []string
+			for _, issue := range issues {
+				rules = append(rules, issue.Rule)
+			}
+			if !reflect.DeepEqual(tc.rules, rules) {
+				t.Errorf("expected broken rules %v but got %v", tc.rules, rules)
+			}
+		})
+	}
+}
+
+func TestDefaultValidationAcceptsDump(t *testing.T) {
+	fh, err := os.Open("dump.csv")
+	if err != nil {
+		t.Fatalf("couldn't open dump: %v", err)
+	}
+	defer fh.Close()
+	items, err := readCSV(fh)
+	if err != nil {
+		t.Fatalf("couldn't read dump: %v", err)
+	}
+	if valid, _ := newValidator(defaultValidationConfig).validate(items); len(valid) != len(items) {
+		t.Errorf("expected all %v items to be valid but got %v", len(items), len(valid))
+	}
+}